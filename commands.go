@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"firewall_script_docker/config"
+	"firewall_script_docker/policy"
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+)
+
+// command is a subcommand of the binary, run returns the process exit code
+type command struct {
+	description string
+	run         func(args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	// assigned in init as the help command reads the map itself
+	commands = map[string]command{
+		"init":     {"create the config directory and the access files", runInit},
+		"render":   {"print the generated ruleset to stdout", runRender},
+		"apply":    {"generate and apply the ruleset, -daemon keeps it in sync with docker", runApply},
+		"confirm":  {"keep the rules applied by a running apply -rollback-timeout", runConfirm},
+		"validate": {"report every problem of the policy or the access files with its line and column", runValidate},
+		"import":   {"write the policy file from the four access files", runImport},
+		"diff":     {"show the rules apply would add and remove from the live ruleset", runDiff},
+		"status":   {"show the generated and live rulesets and the docker state", runStatus},
+		"help":     {"show this help", func([]string) int { usage(); return 0 }},
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for the flags of a command\n", filepath.Base(os.Args[0]))
+}
+
+// newFlagSet returns the flag set of a command with the config flags registered
+func newFlagSet(name string) (*flag.FlagSet, *config.Loader) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	return flags, config.NewLoader(flags)
+}
+
+// loadConfig parses the command line of a command and loads its Config
+func loadConfig(flags *flag.FlagSet, loader *config.Loader, args []string) (*config.Config, bool) {
+	flags.Parse(args)
+	cfg, err := loader.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config:", err)
+		return nil, false
+	}
+	return cfg, true
+}
+
+// bootstrap runs config.Bootstrap and reports the files it created
+func bootstrap(cfg *config.Config, dryRun bool) bool {
+	created, err := config.Bootstrap(cfg, dryRun)
+	for _, path := range created {
+		if dryRun {
+			fmt.Println("Would create:", path)
+		} else {
+			fmt.Println("Created:", path)
+		}
+	}
+	if err != nil {
+		fmt.Println("Error:", err)
+		return false
+	}
+	return true
+}
+
+func runInit(args []string) int {
+	flags, loader := newFlagSet("init")
+	dryRun := flags.Bool("dry-run", false, "only print the files that would be created")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+	if !bootstrap(cfg, *dryRun) {
+		return 1
+	}
+	return 0
+}
+
+func runRender(args []string) int {
+	flags, loader := newFlagSet("render")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+
+	cli, err := newDockerClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	if cli != nil {
+		defer cli.Close()
+	}
+	data, err := collectData(cfg, cli)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error collecting firewall data:", err)
+		return 1
+	}
+	data.CurrentDate = currentDate()
+	rules, err := utils.GenerateRules(cfg, data)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error generating firewall rules:", err)
+		return 1
+	}
+	fmt.Print(rules.Rules)
+	if rules.IPv6Rules != "" {
+		fmt.Print("\n", rules.IPv6Rules)
+	}
+	return 0
+}
+
+func runApply(args []string) int {
+	var rollback utils.RollbackOptions
+	flags, loader := newFlagSet("apply")
+	flags.DurationVar(&rollback.Timeout, "rollback-timeout", 0, "restore the previous ruleset unless the new one is confirmed within this duration (0 disables)")
+	flags.StringVar(&rollback.ProbeAddr, "probe-addr", "", "listen on this address while waiting, a connection from an admin ip confirms the rules (e.g. :9999)")
+	daemon := flags.Bool("daemon", false, "keep running and regenerate the rules when docker containers or networks change")
+	debounce := flags.Duration("debounce", 2*time.Second, "in daemon mode, wait for docker events to settle this long before regenerating")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+
+	if !bootstrap(cfg, false) {
+		return 1
+	}
+	cli, err := newDockerClient()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if cli != nil {
+		defer cli.Close()
+	}
+	if *daemon {
+		if !runDaemon(cfg, cli, rollback, *debounce) {
+			return 1
+		}
+		return 0
+	}
+	if execFirewall(cfg, cli, rollback, utils.Ruleset{}) == (utils.Ruleset{}) {
+		return 1
+	}
+	return 0
+}
+
+func runConfirm(args []string) int {
+	flags, loader := newFlagSet("confirm")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+	if err := utils.Confirm(cfg); err != nil {
+		fmt.Println("Error confirming rules:", err)
+		return 1
+	}
+	return 0
+}
+
+// dockerContainers returns the docker containers, false when docker is not installed or
+// can't be reached
+func dockerContainers() ([]structs.ContainerInfo, bool) {
+	cli, err := newDockerClient()
+	if err != nil {
+		fmt.Println("Error:", err)
+	}
+	if cli == nil {
+		return nil, false
+	}
+	defer cli.Close()
+	containers, err := utils.GetContainerInfos(cli)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return nil, false
+	}
+	return containers, true
+}
+
+func runValidate(args []string) int {
+	flags, loader := newFlagSet("validate")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+
+	var diagnostics []utils.Diagnostic
+	containers, dockerInstalled := dockerContainers()
+	if _, err := os.Stat(cfg.PolicyFile); err == nil {
+		diagnostics = policy.Diagnose(cfg.PolicyFile)
+	} else {
+		published, checkPublished := utils.UniquePublicPorts(containers), dockerInstalled
+		diagnostics = append(diagnostics, utils.ValidateAdminFile(cfg.AdminFilePath)...)
+		diagnostics = append(diagnostics, utils.ValidateAccessFile(cfg.EntityFilePath, nil, false)...)
+		diagnostics = append(diagnostics, utils.ValidateAccessFile(cfg.IpsPath, published, checkPublished)...)
+		diagnostics = append(diagnostics, utils.ValidatePublicPortsFile(cfg.PublicPortPath)...)
+	}
+	diagnostics = append(diagnostics, utils.ValidateContainerLabels(containers)...)
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+	}
+	if len(diagnostics) > 0 {
+		fmt.Printf("%d problems found\n", len(diagnostics))
+		return 1
+	}
+	fmt.Println("no problems found")
+	return 0
+}
+
+func runImport(args []string) int {
+	flags, loader := newFlagSet("import")
+	dryRun := flags.Bool("dry-run", false, "print the policy instead of writing it")
+	force := flags.Bool("force", false, "overwrite an existing policy file")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+
+	accessPolicy, err := policy.Import(cfg)
+	if err != nil {
+		fmt.Println("Error importing the access files:", err)
+		return 1
+	}
+	content, err := accessPolicy.Marshal()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 1
+	}
+	if *dryRun {
+		fmt.Print(string(content))
+		return 0
+	}
+	if _, err := os.Stat(cfg.PolicyFile); err == nil && !*force {
+		fmt.Printf("Error: %s already exists, use -force to overwrite it\n", cfg.PolicyFile)
+		return 1
+	}
+	if err := os.WriteFile(cfg.PolicyFile, content, 0644); err != nil {
+		fmt.Println("Error writing the policy:", err)
+		return 1
+	}
+	fmt.Println("Created:", cfg.PolicyFile)
+	return 0
+}
+
+// printDiff prints the chains that differ between a live and a generated ruleset and returns their number
+func printDiff(cfg *config.Config, family string, live []byte, generated string) int {
+	diffs := utils.DiffRulesets(string(live), generated, utils.NoFlush(cfg))
+	for _, diff := range diffs {
+		fmt.Printf("%s %s", family, diff)
+	}
+	return len(diffs)
+}
+
+func runDiff(args []string) int {
+	flags, loader := newFlagSet("diff")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 2
+	}
+	if cfg.Backend != utils.BackendIPTables {
+		fmt.Println("Error: diff only supports the iptables backend")
+		return 2
+	}
+
+	cli, err := newDockerClient()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return 2
+	}
+	if cli != nil {
+		defer cli.Close()
+	}
+	data, err := collectData(cfg, cli)
+	if err != nil {
+		fmt.Println("Error collecting firewall data:", err)
+		return 2
+	}
+	rules, err := utils.GenerateRules(cfg, data)
+	if err != nil {
+		fmt.Println("Error generating firewall rules:", err)
+		return 2
+	}
+	live, err := utils.SaveRules(cfg)
+	if err != nil {
+		fmt.Println("Error reading the live rules:", err)
+		return 2
+	}
+
+	changed := printDiff(cfg, "ipv4", live.Rules, rules.Rules)
+	if cfg.Ip6tablesRestoreBinary != "" {
+		changed += printDiff(cfg, "ipv6", live.IPv6Rules, rules.IPv6Rules)
+	}
+	if changed > 0 {
+		return 1
+	}
+	fmt.Println("no changes")
+	return 0
+}
+
+func runStatus(args []string) int {
+	flags, loader := newFlagSet("status")
+	cfg, ok := loadConfig(flags, loader, args)
+	if !ok {
+		return 1
+	}
+
+	rulesFile := utils.RulesFile(cfg)
+	if info, err := os.Stat(rulesFile); err == nil {
+		fmt.Printf("generated rules: %s (%s)\n", rulesFile, info.ModTime().Format(time.RFC1123))
+	} else {
+		fmt.Printf("generated rules: %s not generated yet\n", rulesFile)
+	}
+
+	cli, err := newDockerClient()
+	switch {
+	case err != nil:
+		fmt.Println(err)
+	case cli == nil:
+		fmt.Println("docker: not installed")
+	default:
+		containers, err := utils.GetContainerInfos(cli)
+		cli.Close()
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Printf("docker: %d containers on %d custom networks\n", len(containers), len(utils.GetUniqueNetworkIDs(containers)))
+		}
+	}
+
+	live, err := utils.SaveRules(cfg)
+	if err != nil {
+		fmt.Println("live rules: could not be read:", err)
+		return 1
+	}
+	switch cfg.Backend {
+	case utils.BackendIPTables:
+		fmt.Printf("live rules: %d ipv4 rules, %d ipv6 rules loaded\n", bytes.Count(live.Rules, []byte("\n-A ")), bytes.Count(live.IPv6Rules, []byte("\n-A ")))
+	case utils.BackendNftables:
+		fmt.Printf("live rules: inet filter table loaded: %t\n", bytes.Contains(live.Rules, []byte("table inet filter")))
+	}
+	return 0
+}
@@ -3,71 +3,103 @@ package config
 import (
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 )
 
-const (
-	// relative path should end with trailing slash!!
-	// RelativePath = "./firewall_files/" // to use in dev mode
-	RelativePath   = "/usr/local/etc/firewall/" // to use in prod
-	IptablesBinary = "/usr/sbin/iptables"
-	ScriptPath     = RelativePath + "set_firewall.sh"
+// DefaultConfigFile is read when neither -config nor FIREWALL_CONFIG name another file
+const DefaultConfigFile = "/usr/local/etc/firewall/config.yaml"
+
+// Config holds the paths and binaries used by every command. It is built by Load from
+// the defaults, the config file, FIREWALL_* environment variables and flags, in that order
+// of precedence. File paths left empty are placed in RelativePath.
+type Config struct {
+	// directory where the access files and the generated rules live
+	// use e.g. ./firewall_files/ in dev mode
+	RelativePath string `yaml:"relative_path"`
+	// firewall backend to render and apply rules with, iptables or nftables
+	Backend string `yaml:"backend"`
+	// tables rewrites the whole filter and nat tables, chains only manages the FIREWALL- chains
+	// jumped to from INPUT, DOCKER-USER and nat PREROUTING and applies them with --noflush,
+	// docker-user manages INPUT, OUTPUT and DOCKER-USER and leaves the chains of dockerd alone
+	IptablesMode   string `yaml:"iptables_mode"`
+	IptablesBinary string `yaml:"iptables_binary"`
+	// used to snapshot the live ruleset and restore it when an apply is rolled back
+	IptablesSaveBinary    string `yaml:"iptables_save_binary"`
+	IptablesRestoreBinary string `yaml:"iptables_restore_binary"`
+	// ipv6 rules are applied alongside the ipv4 ones, an empty restore binary leaves ipv6 unmanaged
+	Ip6tablesSaveBinary    string `yaml:"ip6tables_save_binary"`
+	Ip6tablesRestoreBinary string `yaml:"ip6tables_restore_binary"`
+	// nft binary used when the nftables backend is selected
+	NftBinary string `yaml:"nft_binary"`
+	// the iptables backend moves the allowed sources to ipsets when set, empty lists them in the rules
+	IpsetBinary string `yaml:"ipset_binary"`
 	// admin_access_domains file where you put hosts or ips that will have access everything in the server
 	// format host or ip in each line
 	// should put your ip or domain access in admin_access_domains file otherwise you will loose access to the server
-	AdminFilePath = RelativePath + "admin_access_domains.txt"
+	AdminFilePath string `yaml:"admin_file_path"`
 	// entity_access_domains file where you put hosts or ips that will have access to some particular ports in the server
 	// format host:80,443 in each line
-	EntityFilePath = RelativePath + "entity_access_domains.txt"
+	EntityFilePath string `yaml:"entity_file_path"`
 	// authorized_access_ips file where you put hosts or ips that will have access to certain containers ports
 	// format host:80,443 in each line
-	IpsPath = RelativePath + "authorized_access_ips.txt"
+	IpsPath string `yaml:"ips_path"`
 	// this file contains ports that will be public to everyone
-	PublicPortPath    = RelativePath + "public_ports.txt"
-	IptablesRulesFile = RelativePath + "GENERATED_IPTABLES_RULES.rules"
-)
+	PublicPortPath string `yaml:"public_port_path"`
+	// yaml policy with groups, services and rules, used instead of the four files above when it exists
+	PolicyFile         string `yaml:"policy_file"`
+	IptablesRulesFile  string `yaml:"iptables_rules_file"`
+	Ip6tablesRulesFile string `yaml:"ip6tables_rules_file"`
+	NftRulesFile       string `yaml:"nft_rules_file"`
+	IpsetRulesFile     string `yaml:"ipset_rules_file"`
+	// created by the confirm command to keep rules applied with a rollback timeout
+	ConfirmFile string `yaml:"confirm_file"`
+}
 
-func createFile(filePath string) error {
-	file, err := os.Create(filePath)
-	if err != nil {
-		return err
+// Default returns the production configuration
+func Default() *Config {
+	return &Config{
+		RelativePath:           "/usr/local/etc/firewall/",
+		Backend:                "iptables",
+		IptablesMode:           "tables",
+		IptablesBinary:         "/usr/sbin/iptables",
+		IptablesSaveBinary:     "/usr/sbin/iptables-save",
+		IptablesRestoreBinary:  "/usr/sbin/iptables-restore",
+		Ip6tablesSaveBinary:    "/usr/sbin/ip6tables-save",
+		Ip6tablesRestoreBinary: "/usr/sbin/ip6tables-restore",
+		NftBinary:              "/usr/sbin/nft",
 	}
-	defer file.Close()
-	return nil
 }
 
-func createFirewallScript() error {
-	// Content of the set_firewall.sh script
-	scriptContent := `#!/bin/bash
-
-# Function to print current date and time
-print_datetime() {
-    date +"%Y-%m-%d %H:%M:%S"
+// resolvePaths places every file path that was not configured in RelativePath
+func (c *Config) resolvePaths() {
+	defaults := []struct {
+		path *string
+		name string
+	}{
+		{&c.AdminFilePath, "admin_access_domains.txt"},
+		{&c.EntityFilePath, "entity_access_domains.txt"},
+		{&c.IpsPath, "authorized_access_ips.txt"},
+		{&c.PublicPortPath, "public_ports.txt"},
+		{&c.PolicyFile, "policy.yaml"},
+		{&c.IptablesRulesFile, "GENERATED_IPTABLES_RULES.rules"},
+		{&c.Ip6tablesRulesFile, "GENERATED_IP6TABLES_RULES.rules"},
+		{&c.NftRulesFile, "GENERATED_NFTABLES_RULES.nft"},
+		{&c.IpsetRulesFile, "GENERATED_IPSETS.ipset"},
+		{&c.ConfirmFile, "CONFIRM_RULES"},
+	}
+	for _, d := range defaults {
+		if *d.path == "" {
+			*d.path = filepath.Join(c.RelativePath, d.name)
+		}
+	}
 }
 
-if ! /usr/sbin/iptables-restore < "$1"; then
-    echo "$(print_datetime): Error occurred while restoring iptables rules." >&2
-    exit 1
-else
-    echo "$(print_datetime): iptables rules restored successfully."
-    exit 0
-fi
-`
-
-	// Create or overwrite the set_firewall.sh file
-	file, err := os.Create(ScriptPath)
+func createFile(filePath string) error {
+	file, err := os.Create(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-
-	// Write the script content into the file
-	_, err = file.WriteString(scriptContent)
-	if err != nil {
-		return err
-	}
-
-	fmt.Println("set_firewall.sh file created successfully.")
 	return nil
 }
 
@@ -76,34 +108,29 @@ func fileExists(filename string) bool {
 	return !os.IsNotExist(err)
 }
 
-func init() {
-	if !strings.HasSuffix(RelativePath, "/") {
-		panic("Relative Path Should have trailing slash")
-	}
-	if !fileExists(ScriptPath) {
-		if err := createFirewallScript(); err != nil {
-			fmt.Println("Error:", err)
+// Bootstrap creates the config directory and the empty access files
+// that do not exist yet and returns the paths it created. With dryRun nothing is
+// written and the returned paths are the ones that would have been created.
+func Bootstrap(cfg *Config, dryRun bool) ([]string, error) {
+	var created []string
+	if !fileExists(cfg.RelativePath) {
+		if !dryRun {
+			if err := os.MkdirAll(cfg.RelativePath, 0755); err != nil {
+				return created, err
+			}
 		}
+		created = append(created, cfg.RelativePath)
 	}
-	// Load .env file obly in dev mode , for production use docker environment variables
-	err := os.MkdirAll(RelativePath, 0755)
-	if err != nil {
-		panic(err)
-	}
-	filePaths := []string{AdminFilePath, EntityFilePath, IpsPath, PublicPortPath}
+	filePaths := []string{cfg.AdminFilePath, cfg.EntityFilePath, cfg.IpsPath, cfg.PublicPortPath}
 	for _, filePath := range filePaths {
 		if !fileExists(filePath) {
-			if err := createFile(filePath); err != nil {
-				fmt.Printf("Error creating file %s: %v\n", filePath, err)
-				return
+			if !dryRun {
+				if err := createFile(filePath); err != nil {
+					return created, fmt.Errorf("creating %s: %w", filePath, err)
+				}
 			}
-			fmt.Printf("File created successfully: %s\n", filePath)
+			created = append(created, filePath)
 		}
-
-	}
-
-	if !fileExists(AdminFilePath) {
-		// If the file doesn't exist, panic
-		panic(fmt.Sprintf("File %s doesn't exist!", AdminFilePath))
 	}
+	return created, nil
 }
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// setting is a configurable value, its yaml key also names its
+// FIREWALL_ environment variable and its flag
+type setting struct {
+	key   string
+	value *string
+	usage string
+}
+
+// settings lists every value of the Config that can be set from the environment or flags
+func (c *Config) settings() []setting {
+	return []setting{
+		{"relative_path", &c.RelativePath, "directory of the access files and the generated rules"},
+		{"backend", &c.Backend, "firewall backend to render and apply rules with (iptables or nftables)"},
+		{"iptables_mode", &c.IptablesMode, "tables rewrites the filter and nat tables, chains only manages the FIREWALL- chains and keeps the rules of other tools, docker-user leaves the docker chains to dockerd"},
+		{"iptables_binary", &c.IptablesBinary, "path to the iptables binary"},
+		{"iptables_save_binary", &c.IptablesSaveBinary, "path to the iptables-save binary"},
+		{"iptables_restore_binary", &c.IptablesRestoreBinary, "path to the iptables-restore binary"},
+		{"ip6tables_save_binary", &c.Ip6tablesSaveBinary, "path to the ip6tables-save binary"},
+		{"ip6tables_restore_binary", &c.Ip6tablesRestoreBinary, "path to the ip6tables-restore binary, empty leaves ipv6 unmanaged"},
+		{"nft_binary", &c.NftBinary, "path to the nft binary"},
+		{"ipset_binary", &c.IpsetBinary, "path to the ipset binary, the iptables backend matches the allowed sources with ipsets when set"},
+		{"admin_file_path", &c.AdminFilePath, "file with the hosts that have access to everything"},
+		{"entity_file_path", &c.EntityFilePath, "file with the hosts that have access to some ports, host:80,443"},
+		{"ips_path", &c.IpsPath, "file with the hosts that have access to some container ports, host:80,443"},
+		{"public_port_path", &c.PublicPortPath, "file with the ports open to everyone"},
+		{"policy_file", &c.PolicyFile, "yaml policy used instead of the four access files when it exists"},
+		{"iptables_rules_file", &c.IptablesRulesFile, "file where the generated iptables rules are saved"},
+		{"ip6tables_rules_file", &c.Ip6tablesRulesFile, "file where the generated ip6tables rules are saved"},
+		{"nft_rules_file", &c.NftRulesFile, "file where the generated nftables ruleset is saved"},
+		{"ipset_rules_file", &c.IpsetRulesFile, "file where the generated ipset restore script is saved"},
+		{"confirm_file", &c.ConfirmFile, "file created by the confirm command"},
+	}
+}
+
+func envName(key string) string {
+	return "FIREWALL_" + strings.ToUpper(key)
+}
+
+func flagName(key string) string {
+	return strings.ReplaceAll(key, "_", "-")
+}
+
+// Loader registers the config flags on a command flag set and builds the Config once they are parsed
+type Loader struct {
+	configFile *string
+	flags      *flag.FlagSet
+	values     map[string]*string
+}
+
+// NewLoader registers -config and one flag per setting on flags
+func NewLoader(flags *flag.FlagSet) *Loader {
+	loader := &Loader{
+		configFile: flags.String("config", "", "config file (default $FIREWALL_CONFIG or "+DefaultConfigFile+")"),
+		flags:      flags,
+		values:     make(map[string]*string),
+	}
+	for _, s := range Default().settings() {
+		loader.values[s.key] = flags.String(flagName(s.key), "", fmt.Sprintf("%s (env %s)", s.usage, envName(s.key)))
+	}
+	return loader
+}
+
+// Load builds the Config from the defaults, overridden by the config file, then by
+// FIREWALL_* environment variables, then by the flags given on the command line.
+// The flag set must have been parsed.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+
+	configFile, explicit := *l.configFile, true
+	if configFile == "" {
+		configFile, explicit = os.Getenv("FIREWALL_CONFIG"), true
+	}
+	if configFile == "" {
+		configFile, explicit = DefaultConfigFile, false
+	}
+	content, err := os.ReadFile(configFile)
+	if err == nil {
+		if err := yaml.Unmarshal(content, cfg); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", configFile, err)
+		}
+	} else if explicit || !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, s := range cfg.settings() {
+		if value, found := os.LookupEnv(envName(s.key)); found {
+			*s.value = value
+		}
+	}
+
+	setFlags := make(map[string]bool)
+	l.flags.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	for _, s := range cfg.settings() {
+		if setFlags[flagName(s.key)] {
+			*s.value = *l.values[s.key]
+		}
+	}
+
+	if cfg.RelativePath == "" {
+		return nil, fmt.Errorf("relative_path should not be empty")
+	}
+	cfg.resolvePaths()
+	return cfg, nil
+}
@@ -2,7 +2,10 @@ module firewall_script_docker
 
 go 1.22.1
 
-require github.com/docker/docker v26.1.1+incompatible
+require (
+	github.com/docker/docker v26.1.1+incompatible
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/Microsoft/go-winio v0.6.2 // indirect
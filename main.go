@@ -1,115 +1,239 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"firewall_script_docker/config"
+	"firewall_script_docker/policy"
 	"firewall_script_docker/structs"
 	"firewall_script_docker/utils"
 
 	"github.com/docker/docker/client"
 )
 
-// writeToFile writes content to a file specified by the filePath parameter.
-func writeToFile(filePath, content string) error {
-	file, err := os.Create(filePath)
+// newDockerClient returns a docker client, or nil when docker is not installed.
+func newDockerClient() (*client.Client, error) {
+	if !utils.IsDockerInstalled() {
+		return nil, nil
+	}
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		return err
+		return nil, &utils.DockerError{Op: "creating client", Err: err}
 	}
-	defer file.Close()
+	return cli, nil
+}
 
-	_, err = file.WriteString(content)
-	return err
+// readAccess fills the admin ips, the hosts allowed to some ports, the ips allowed to some
+// container ports, the public ports and the hostnames the addresses were resolved from,
+// from the policy file when it exists or the access files
+func readAccess(cfg *config.Config) (structs.Data, error) {
+	var data structs.Data
+	var publicPorts string
+	if accessPolicy, err := policy.Load(cfg.PolicyFile); err == nil {
+		var ports []structs.Port
+		data.Admins, data.EntityDomains, ports = accessPolicy.Resolve()
+		data.Groups = accessPolicy.Groups
+		data.ContainerRules = accessPolicy.ContainerRules()
+		var written []string
+		for _, port := range ports {
+			written = append(written, port.String())
+		}
+		publicPorts = strings.Join(written, ",")
+	} else if !os.IsNotExist(err) {
+		return data, &utils.AccessError{File: cfg.PolicyFile, Err: err}
+	} else {
+		if data.Admins, err = utils.GetAdmins(cfg.AdminFilePath); err != nil {
+			return data, &utils.AccessError{File: cfg.AdminFilePath, Err: err}
+		}
+		if data.EntityDomains, err = utils.ProcessDomainFile(cfg.EntityFilePath); err != nil {
+			return data, &utils.AccessError{File: cfg.EntityFilePath, Err: err}
+		}
+		if data.MappedData, data.HostNames, err = utils.ProcessAuthorizedAccessFile(cfg.IpsPath); err != nil {
+			return data, &utils.AccessError{File: cfg.IpsPath, Err: err}
+		}
+		if publicPorts, _, err = utils.GetPublicPorts(cfg.PublicPortPath); err != nil {
+			return data, &utils.AccessError{File: cfg.PublicPortPath, Err: err}
+		}
+	}
+	if data.HostNames == nil {
+		data.HostNames = make(map[string]string)
+	}
+	for ip, host := range utils.EntityHostNames(data.EntityDomains) {
+		data.HostNames[ip] = host
+	}
+	data.PublicPortMetaData = structs.PublicPortMetaData{
+		PublicPorts:    publicPorts,
+		HasPublicPorts: publicPorts != "",
+		Ports:          utils.ParsePorts(publicPorts),
+	}
+	return data, nil
 }
 
-// execFirewall executes the firewall script.
-func execFirewall() {
-	// get admin ips
-	adminIps := utils.GetAdminIPs(config.AdminFilePath)
-	if len(adminIps) == 0 {
-		panic("admins are not set put domains access in admin_access_domains")
-	}
-	// Get current date and time
-	currentDate := time.Now().Format("Mon Jan 2 15:04:05 2006")
+// collectData reads the access policy and the docker containers the ruleset is
+// rendered from. CurrentDate is left empty for the caller to set.
+func collectData(cfg *config.Config, cli *client.Client) (structs.Data, error) {
+	// get admin ips, entities, authorized ips and public ports
+	data, err := readAccess(cfg)
+	if err != nil {
+		return data, err
+	}
+	if len(data.Admins) == 0 {
+		return data, utils.ErrNoAdmins
+	}
 	// Get iptables version
-	iptablesVersion, _ := exec.Command(config.IptablesBinary, "-V").Output()
-	// Check if Docker is installed
-	isDockerInstalled := utils.IsDockerInstalled()
+	iptablesVersion, _ := exec.Command(cfg.IptablesBinary, "-V").Output()
+	data.IPTablesVersion = string(iptablesVersion)
 	// Fetch container information if Docker is installed
-	var containerInfos []structs.ContainerInfo
-	if isDockerInstalled {
-		cli, err := client.NewClientWithOpts(client.FromEnv)
-		if err != nil {
-			panic(err)
+	data.DockerInstalled = cli != nil
+	if data.DockerInstalled {
+		if data.ContainerInfos, err = utils.GetContainerInfos(cli); err != nil {
+			return data, err
+		}
+		for ip, host := range utils.ResolveContainerAccess(data.ContainerInfos, data.Groups, data.ContainerRules) {
+			data.HostNames[ip] = host
 		}
-		containerInfos = utils.GetContainerInfos(cli)
+		data.IPv6DockerUser = utils.HasIPv6DockerUser(cfg)
 	}
 	// Process various configuration files
-	mappedIpsAccess := utils.ProcessAuthorizedAccessFile(config.IpsPath)
-	publicContainerPorts := utils.UniquePublicPorts(containerInfos)
-	filteredAllowedArray := utils.FilterPortsArray(mappedIpsAccess, publicContainerPorts)
-	fmt.Println(filteredAllowedArray)
-	public_ports, hasPublicPorts := utils.GetPublicPorts(config.PublicPortPath)
-	UniqueNetworkIDs := utils.GetUniqueNetworkIDs(containerInfos)
-	entityDomains, _ := utils.ProcessDomainFile(config.EntityFilePath)
-	// Generate iptables rules based on the collected data
-	iptablesRules, err := utils.GenerateIPTablesRules(structs.Data{
-		CurrentDate:      currentDate,
-		IPTablesVersion:  string(iptablesVersion),
-		Admins:           adminIps,
-		EntityDomains:    entityDomains,
-		ContainerInfos:   containerInfos,
-		UniqueNetworkIDs: UniqueNetworkIDs,
-		DockerInstalled:  isDockerInstalled,
-		PublicPortMetaData: structs.PublicPortMetaData{
-			PublicPorts:    public_ports,
-			HasPublicPorts: hasPublicPorts,
-		},
-		MappedData:  mappedIpsAccess,
-		MappedData2: filteredAllowedArray,
-	})
+	publicContainerPorts := utils.UniquePublicPorts(data.ContainerInfos)
+	data.MappedData2 = utils.FilterPortsArray(data.MappedData, publicContainerPorts)
+	data.UniqueNetworkIDs = utils.GetUniqueNetworkIDs(data.ContainerInfos)
+	return data, nil
+}
 
+// currentDate returns the generation date written at the top of the rulesets.
+func currentDate() string {
+	return time.Now().Format("Mon Jan 2 15:04:05 2006")
+}
+
+// execFirewall generates the ruleset for the configured backend and applies it,
+// with an automatic rollback when rollback.Timeout is set. The ruleset is only
+// applied when it differs from lastRules, the value returned by the previous run. On any
+// error lastRules is returned and the previously applied ruleset stays in place.
+func execFirewall(cfg *config.Config, cli *client.Client, rollback utils.RollbackOptions, lastRules utils.Ruleset) utils.Ruleset {
+	data, err := collectData(cfg, cli)
 	if err != nil {
-		fmt.Println("Error generating iptables rules:", err)
-		return
+		fmt.Println("Error collecting firewall data:", err)
+		return lastRules
 	}
-	// Write iptables rules to file
-	err = writeToFile(config.IptablesRulesFile, iptablesRules)
+	// Render without the generation date first to find out if anything changed
+	currentRules, err := utils.GenerateRules(cfg, data)
 	if err != nil {
-		fmt.Println("Error writing iptables rules to file:", err)
-		return
+		fmt.Println("Error generating firewall rules:", err)
+		return lastRules
 	}
-
-	relPath, err := filepath.Abs(config.IptablesRulesFile)
-
+	if currentRules == lastRules {
+		fmt.Println("Firewall rules unchanged")
+		return lastRules
+	}
+	// Only the members of the ipsets changed, swap them without reloading the rules. With a
+	// rollback the full apply below snapshots and restores the members.
+	if currentRules.Rules == lastRules.Rules && currentRules.IPv6Rules == lastRules.IPv6Rules && rollback.Timeout == 0 {
+		if err := utils.WriteIPSets(cfg, currentRules); err != nil {
+			fmt.Println("Error writing ipsets to file:", err)
+			return lastRules
+		}
+		if _, err := utils.ApplyIPSets(cfg); err != nil {
+			fmt.Println("Error:", err)
+			return lastRules
+		}
+		fmt.Printf("%s: ipset members updated\n", time.Now().Format("2006-01-02 15:04:05"))
+		return currentRules
+	}
+	// Generate firewall rules based on the collected data
+	data.CurrentDate = currentDate()
+	rules, err := utils.GenerateRules(cfg, data)
 	if err != nil {
-		fmt.Println("Error getting relative path:", err)
-		return
+		fmt.Println("Error generating firewall rules:", err)
+		return lastRules
+	}
+	// Write the ruleset to the files of the selected backend
+	err = utils.WriteRules(cfg, rules)
+	if err != nil {
+		fmt.Println("Error writing firewall rules to file:", err)
+		return lastRules
 	}
 
-	// Apply iptables rules
-	output, err := utils.ApplyIPTablesRules(relPath)
+	// Apply the ruleset
+	var output []byte
+	if rollback.Timeout > 0 {
+		rollback.AdminIPs = data.AdminSources()
+		output, err = utils.ApplyRulesWithRollback(cfg, rollback)
+	} else {
+		output, err = utils.ApplyRules(cfg)
+	}
 
 	if err != nil {
 		fmt.Println("Error:", err)
-	} else {
+		return lastRules
+	}
+	if len(output) > 0 {
+		fmt.Print(string(output))
+	}
+	fmt.Printf("%s: firewall rules applied\n", time.Now().Format("2006-01-02 15:04:05"))
+	return currentRules
+}
 
-		fmt.Println(string(output))
+// runDaemon applies the ruleset and applies it again after every burst of docker
+// container and network events and every time a hostname of the access files resolves
+// to other addresses, until the process is interrupted. Without docker only the
+// hostnames are watched. The rollback only guards the first apply, the later ones run
+// unattended and nobody would confirm them, so the daemon stops when the first apply is
+// rolled back or fails instead of applying the same rules again unguarded.
+func runDaemon(cfg *config.Config, cli *client.Client, rollback utils.RollbackOptions, debounce time.Duration) bool {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// the hosts are re-resolved when their ttl expires
+	utils.UseRecordTTLs()
+
+	var mu sync.Mutex
+	var lastRules utils.Ruleset
+	regenerate := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		start := time.Now()
+		lastRules = execFirewall(cfg, cli, rollback, lastRules)
+		// hosts removed from the access files are no longer re-resolved
+		utils.PruneHosts(start)
+	}
+	regenerate()
+	if rollback.Timeout > 0 && lastRules == (utils.Ruleset{}) {
+		return false
 	}
+	rollback = utils.RollbackOptions{}
+	hostsChanged := func() {
+		fmt.Println("Resolved host addresses changed, regenerating firewall rules")
+		regenerate()
+	}
+	if cli == nil {
+		utils.WatchHosts(ctx, hostsChanged)
+		return true
+	}
+	go utils.WatchHosts(ctx, hostsChanged)
+	utils.WatchDockerEvents(ctx, cli, debounce, func() {
+		fmt.Println("Docker topology changed, regenerating firewall rules")
+		regenerate()
+	})
+	return true
 }
 
 func main() {
-	// Execute the firewall script initially
-	execFirewall()
-	// Run the firewall script repeatedly after the defined interval
-	// interval := 10 * time.Second
-	// for {
-	// 	<-time.After(interval)
-	// 	fmt.Println("Running task...")
-	// 	execFirewall()
-	// }
+	// running without a command keeps the original behaviour of generating and applying the rules
+	if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runApply(os.Args[1:]))
+	}
+	command, found := commands[os.Args[1]]
+	if !found {
+		usage()
+		os.Exit(2)
+	}
+	os.Exit(command.run(os.Args[2:]))
 }
@@ -0,0 +1,128 @@
+package policy
+
+import (
+	"firewall_script_docker/utils"
+	"fmt"
+	"os"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mappingValue returns the value of a key of a yaml mapping node, nil when it is missing
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// sequence returns the items of a yaml sequence node
+func sequence(node *yaml.Node) []*yaml.Node {
+	if node == nil || node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	return node.Content
+}
+
+// Diagnose parses the policy file and reports every problem Validate would refuse, plus the
+// hosts that can't be resolved and the duplicate entries, with their line and column
+func Diagnose(filePath string) []utils.Diagnostic {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return []utils.Diagnostic{{File: filePath, Reason: err.Error()}}
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(content, &root); err != nil {
+		return []utils.Diagnostic{{File: filePath, Reason: err.Error()}}
+	}
+	p := &Policy{}
+	if err := root.Decode(p); err != nil {
+		return []utils.Diagnostic{{File: filePath, Reason: err.Error()}}
+	}
+	if len(root.Content) == 0 {
+		return []utils.Diagnostic{{File: filePath, Reason: "the policy is empty"}}
+	}
+	document := root.Content[0]
+
+	var diagnostics []utils.Diagnostic
+	report := func(node *yaml.Node, format string, a ...any) {
+		diagnostics = append(diagnostics, utils.Diagnostic{File: filePath, Line: node.Line, Column: node.Column, Reason: fmt.Sprintf(format, a...)})
+	}
+	checkPorts := func(ports *yaml.Node) {
+		var seen []string
+		for _, port := range sequence(ports) {
+			if _, isValid := utils.ParsePort(port.Value); !isValid {
+				report(port, "bad port %q, expected a port or a range between 1 and 65535 with an optional /tcp, /udp or /sctp", port.Value)
+			} else if slices.Contains(seen, port.Value) {
+				report(port, "duplicate port %s", port.Value)
+			}
+			seen = append(seen, port.Value)
+		}
+	}
+
+	if version := mappingValue(document, "version"); version == nil {
+		report(document, "missing version, expected version: %d", Version)
+	} else if p.Version != Version {
+		report(version, "unsupported policy version %d, expected %d", p.Version, Version)
+	}
+
+	groups := mappingValue(document, "groups")
+	for i := 0; groups != nil && i+1 < len(groups.Content); i += 2 {
+		name := groups.Content[i]
+		if name.Value == Any {
+			report(name, "group %q is reserved for rules open to everyone", Any)
+		}
+		var seen []string
+		for _, host := range sequence(groups.Content[i+1]) {
+			if _, err := utils.LookupHost(host.Value); err != nil {
+				report(host, "host %q could not be resolved", host.Value)
+			} else if slices.Contains(seen, host.Value) {
+				report(host, "duplicate entry, %s is already in group %s", host.Value, name.Value)
+			}
+			seen = append(seen, host.Value)
+		}
+	}
+
+	services := mappingValue(document, "services")
+	for i := 0; services != nil && i+1 < len(services.Content); i += 2 {
+		checkPorts(services.Content[i+1])
+	}
+
+	for _, rule := range sequence(mappingValue(document, "rules")) {
+		from := mappingValue(rule, "from")
+		if from == nil {
+			report(rule, "rule without from, expected a group name or %s", Any)
+			continue
+		}
+		if _, found := p.Groups[from.Value]; !found && from.Value != Any {
+			report(from, "unknown group %q", from.Value)
+		}
+		for _, service := range sequence(mappingValue(rule, "services")) {
+			if _, found := p.Services[service.Value]; !found {
+				report(service, "unknown service %q", service.Value)
+			}
+		}
+		ports := mappingValue(rule, "ports")
+		checkPorts(ports)
+		containers := sequence(mappingValue(rule, "containers"))
+		for _, selector := range containers {
+			if !validSelector(selector.Value) {
+				report(selector, "bad container %q, expected a container name or label=value", selector.Value)
+			}
+		}
+		if from.Value == Any && len(sequence(mappingValue(rule, "services"))) == 0 && len(sequence(ports)) == 0 && len(containers) == 0 {
+			report(from, "a rule from %s must list services, ports or containers", Any)
+		}
+	}
+
+	if admins, _, _ := p.Resolve(); len(admins) == 0 {
+		diagnostics = append(diagnostics, utils.Diagnostic{File: filePath, Reason: "no admin ip could be resolved, apply refuses to run without admins"})
+	}
+	return diagnostics
+}
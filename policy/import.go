@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"firewall_script_docker/config"
+	"firewall_script_docker/utils"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// readLines returns the non blank lines of a file, a missing file has no lines
+func readLines(filePath string) ([]string, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// importAccessFile adds a group and a rule per distinct port list of a host:80,443 file,
+// the groups are named name, name-2, name-3...
+func (p *Policy) importAccessFile(filePath string, name string) error {
+	lines, err := readLines(filePath)
+	if err != nil {
+		return err
+	}
+	groupByPorts := make(map[string]string)
+	for _, line := range lines {
+		host, ports, found := utils.SplitAccessLine(line)
+		if !found {
+			continue
+		}
+		var written []string
+		for _, port := range utils.ParsePorts(ports) {
+			written = append(written, port.String())
+		}
+		if len(written) == 0 {
+			continue
+		}
+		key := strings.Join(written, ",")
+		group, found := groupByPorts[key]
+		if !found {
+			group = name
+			if len(groupByPorts) > 0 {
+				group = fmt.Sprintf("%s-%d", name, len(groupByPorts)+1)
+			}
+			groupByPorts[key] = group
+			p.Rules = append(p.Rules, Rule{From: group, Ports: written})
+		}
+		p.Groups[group] = append(p.Groups[group], host)
+	}
+	return nil
+}
+
+// Import builds a policy from the four access files of cfg. Hosts are kept as they are written
+// so domains are still resolved every time the rules are generated.
+func Import(cfg *config.Config) (*Policy, error) {
+	p := &Policy{Version: Version, Groups: make(map[string][]string)}
+
+	admins, err := readLines(cfg.AdminFilePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(admins) > 0 {
+		p.Groups["admins"] = admins
+		p.Rules = append(p.Rules, Rule{From: "admins"})
+	}
+	if err := p.importAccessFile(cfg.EntityFilePath, "entities"); err != nil {
+		return nil, err
+	}
+	if err := p.importAccessFile(cfg.IpsPath, "authorized"); err != nil {
+		return nil, err
+	}
+	ports, hasPorts, err := utils.GetPublicPorts(cfg.PublicPortPath)
+	if err != nil {
+		return nil, err
+	}
+	if hasPorts {
+		p.Rules = append(p.Rules, Rule{From: Any, Ports: strings.Split(ports, ",")})
+	}
+	return p, p.Validate()
+}
+
+// Marshal returns the policy as a yaml document
+func (p *Policy) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(p); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,182 @@
+package policy
+
+import (
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Version is the version of the policy document this binary understands
+const Version = 1
+
+// Any is the source of a rule open to everyone
+const Any = "any"
+
+// Policy is the declarative access policy, a single yaml document replacing the four access files
+type Policy struct {
+	Version  int                 `yaml:"version"`
+	Groups   map[string][]string `yaml:"groups"`             // named lists of hosts, ips or cidr prefixes
+	Services map[string][]string `yaml:"services,omitempty"` // named lists of ports, 80, 53/udp or 8000-8100
+	Rules    []Rule              `yaml:"rules"`
+}
+
+// Rule allows a group to reach ports on the host and on the containers publishing them,
+// a rule without services or ports gives the group access to everything like the admins file.
+// A rule naming containers only gives access to the ports inside these containers, every
+// published one when it has no services or ports.
+type Rule struct {
+	From       string   `yaml:"from"` // a group name, or any for everyone
+	Services   []string `yaml:"services,omitempty"`
+	Ports      []string `yaml:"ports,omitempty"`
+	Containers []string `yaml:"containers,omitempty"` // container names or label=value selectors
+}
+
+// Load reads and validates the policy file
+func Load(filePath string) (*Policy, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	policy := &Policy{}
+	if err := yaml.Unmarshal(content, policy); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filePath, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", filePath, err)
+	}
+	return policy, nil
+}
+
+// Validate checks the version of the policy and that its rules only use known groups,
+// known services and valid ports
+func (p *Policy) Validate() error {
+	if p.Version != Version {
+		return fmt.Errorf("unsupported policy version %d, expected %d", p.Version, Version)
+	}
+	if _, found := p.Groups[Any]; found {
+		return fmt.Errorf("group %q is reserved for rules open to everyone", Any)
+	}
+	for name, ports := range p.Services {
+		for _, port := range ports {
+			if _, isValid := utils.ParsePort(port); !isValid {
+				return fmt.Errorf("service %s: invalid port %q", name, port)
+			}
+		}
+	}
+	for i, rule := range p.Rules {
+		if _, found := p.Groups[rule.From]; !found && rule.From != Any {
+			return fmt.Errorf("rule %d: unknown group %q", i+1, rule.From)
+		}
+		for _, service := range rule.Services {
+			if _, found := p.Services[service]; !found {
+				return fmt.Errorf("rule %d: unknown service %q", i+1, service)
+			}
+		}
+		for _, port := range rule.Ports {
+			if _, isValid := utils.ParsePort(port); !isValid {
+				return fmt.Errorf("rule %d: invalid port %q", i+1, port)
+			}
+		}
+		for _, selector := range rule.Containers {
+			if !validSelector(selector) {
+				return fmt.Errorf("rule %d: invalid container %q, expected a name or label=value", i+1, selector)
+			}
+		}
+		if rule.From == Any && len(rule.Services) == 0 && len(rule.Ports) == 0 && len(rule.Containers) == 0 {
+			return fmt.Errorf("rule %d: a rule from %s must list services, ports or containers", i+1, Any)
+		}
+	}
+	return nil
+}
+
+// validSelector reports whether selector is a container name or a label=value pair
+func validSelector(selector string) bool {
+	label, _, _ := strings.Cut(selector, "=")
+	return strings.TrimSpace(label) != "" && !strings.ContainsAny(selector, " \t/")
+}
+
+// rulePorts returns the ports of the services of a rule followed by its own ports
+func (p *Policy) rulePorts(rule Rule) []structs.Port {
+	var ports []string
+	for _, service := range rule.Services {
+		ports = append(ports, p.Services[service]...)
+	}
+	ports = append(ports, rule.Ports...)
+	return utils.ParsePorts(strings.Join(ports, ","))
+}
+
+// Resolve looks up the hosts of the groups the way the access files are read and returns the
+// admins, the hosts allowed to some ports and the ports open to everyone
+func (p *Policy) Resolve() ([]structs.Admin, []structs.AccessDomain, []structs.Port) {
+	var admins []structs.Admin
+	var domains []structs.AccessDomain
+	var publicPorts []structs.Port
+	for _, rule := range p.Rules {
+		if len(rule.Containers) > 0 {
+			continue
+		}
+		ports := p.rulePorts(rule)
+		if rule.From == Any {
+			for _, port := range ports {
+				if !slices.Contains(publicPorts, port) {
+					publicPorts = append(publicPorts, port)
+				}
+			}
+			continue
+		}
+		for _, host := range p.Groups[rule.From] {
+			if len(ports) == 0 {
+				admins = utils.AppendAdmins(admins, host)
+				continue
+			}
+			ips, err := utils.LookupHost(host)
+			if err != nil {
+				continue
+			}
+			domains = addDomainPorts(domains, host, ips, ports)
+		}
+	}
+	return admins, domains, publicPorts
+}
+
+// ContainerRules returns the rules giving access to containers, their groups are resolved with
+// the labels of the containers by utils.ResolveContainerAccess
+func (p *Policy) ContainerRules() []structs.ContainerRule {
+	var rules []structs.ContainerRule
+	for _, rule := range p.Rules {
+		if len(rule.Containers) == 0 {
+			continue
+		}
+		access := structs.ContainerAccess{Public: rule.From == Any, Ports: p.rulePorts(rule)}
+		if !access.Public {
+			access.Allow = []string{rule.From}
+		}
+		rules = append(rules, structs.ContainerRule{Containers: rule.Containers, Access: access})
+	}
+	return rules
+}
+
+// addDomainPorts adds ports to the domain of the host, a host in several groups gets the ports of all of them
+func addDomainPorts(domains []structs.AccessDomain, host string, ips []string, ports []structs.Port) []structs.AccessDomain {
+	i := slices.IndexFunc(domains, func(domain structs.AccessDomain) bool { return domain.Name == host })
+	if i < 0 {
+		domains = append(domains, structs.AccessDomain{Name: host, IPs: ips})
+		i = len(domains) - 1
+	}
+	for _, port := range ports {
+		if !slices.Contains(domains[i].PortsArr, port) {
+			domains[i].PortsArr = append(domains[i].PortsArr, port)
+		}
+	}
+	var written []string
+	for _, port := range domains[i].PortsArr {
+		written = append(written, port.String())
+	}
+	domains[i].Ports = strings.Join(written, ",")
+	return domains
+}
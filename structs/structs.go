@@ -1,47 +1,335 @@
 package structs
 
-import "github.com/docker/docker/api/types"
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+)
 
 type NetworkID struct {
 	ID     string
+	Bridge string
 	Subnet string
 }
 
 type Data struct {
 	CurrentDate        string
 	IPTablesVersion    string
-	Admins             string
+	Admins             []Admin // sources with access to everything in the server
 	EntityDomains      []AccessDomain
 	ContainerInfos     []ContainerInfo
-	MappedData         map[string][]uint16 // a map contains ip as key value as slice of ports []uint16 to be allowed to the container if it matched
-	MappedData2        map[string][]uint16 // map of ips as keys and value as filtered ports that should we allow to the servers
+	MappedData         map[string][]Port // a map contains ip as key value as slice of ports to be allowed to the container if it matched
+	MappedData2        map[string][]Port // map of ips as keys and value as filtered ports that should we allow to the servers
 	UniqueNetworkIDs   []NetworkID
 	PublicPortMetaData PublicPortMetaData
 	DockerInstalled    bool
+	// ip6tables-save lists the DOCKER-USER chain, dockerd only creates it with ip6tables enabled
+	IPv6DockerUser bool
+	// the ruleset is rendered for ip6tables, every address above is an ipv6 one
+	IPv6 bool
+	// subnet of the docker0 bridge, empty when docker0 has no subnet in this family
+	DefaultBridgeSubnet string
+	// hostname each entity and authorized address was resolved from, ips written as they are have none
+	HostNames map[string]string
+	// hosts of the policy groups, the firewall.allow label of a container may name them
+	Groups map[string][]string
+	// rules of the policy giving access to containers selected by name or label
+	ContainerRules []ContainerRule
+	// sets the admins, entity domains and authorized ips were moved to, empty when ipsets are not used
+	IPSets []IPSet
+}
+
+// IPSet is an ipset of source addresses matched by the rules instead of listing them one by one
+type IPSet struct {
+	Name    string
+	Family  string // inet or inet6
+	Members []string
+}
+
+// SourceMatch returns the match of a rule source, a set of IPSets is matched with -m set
+// and an address, a prefix or a list of them with -s
+func (d Data) SourceMatch(source string) string {
+	for _, set := range d.IPSets {
+		if set.Name == source {
+			return "-m set --match-set " + source + " src"
+		}
+	}
+	return "-s " + source
+}
+
+// HostComment returns the comment match naming the hostname address was resolved from, empty
+// when the address was written as it is
+func (d Data) HostComment(address string) string {
+	return hostComment(d.HostNames[address])
+}
+
+// AdminSources returns the sources of the admins
+func (d Data) AdminSources() []string {
+	var sources []string
+	for _, admin := range d.Admins {
+		sources = append(sources, admin.Source)
+	}
+	return sources
+}
+
+// hostComment returns the comment match naming host, empty when there is no host
+func hostComment(host string) string {
+	if host == "" {
+		return ""
+	}
+	return " -m comment --comment " + host
+}
+
+// Admin is a source with access to everything in the server
+type Admin struct {
+	Source string // an address, a prefix or the ipset holding them
+	Host   string // hostname Source was resolved from, empty when it was written as it is
+}
+
+// Comment returns the comment match naming the hostname of the admin
+func (a Admin) Comment() string {
+	return hostComment(a.Host)
+}
+
+// DockerForward reports whether the ruleset filters the forwarded docker traffic. For ipv6 it
+// needs the DOCKER-USER chain of dockerd, docker before 27 leaves ip6tables alone by default
+// even when it gives containers ipv6 addresses.
+func (d Data) DockerForward() bool {
+	return d.DockerInstalled && (!d.IPv6 || d.IPv6DockerUser)
+}
+
+// HostPrefixLen returns the prefix length matching a single address of the family
+func (d Data) HostPrefixLen() int {
+	if d.IPv6 {
+		return 128
+	}
+	return 32
+}
+
+// DNATAddress returns address as written before a port in a dnat target, ipv6 addresses need brackets
+func (d Data) DNATAddress(address string) string {
+	if d.IPv6 {
+		return "[" + address + "]"
+	}
+	return address
+}
+
+// LoopbackNet returns the loopback network of the family
+func (d Data) LoopbackNet() string {
+	if d.IPv6 {
+		return "::1/128"
+	}
+	return "127.0.0.0/8"
 }
 
 type PublicPortMetaData struct {
-	PublicPorts    string
+	PublicPorts    string // as validated from the file, 80,443,53/udp
 	HasPublicPorts bool
+	Ports          []Port
+}
+
+// PortsByProto returns the public ports joined by protocol for iptables
+func (p PublicPortMetaData) PortsByProto() map[string]string {
+	return GroupPorts(p.Ports, ":")
 }
 
 type ContainerInfo struct {
-	ContainerID   string
-	NetworkData   NetworkMetaData
-	NetworkSubnet string
-	IPAddress     string
-	Ports         []types.Port
+	ContainerID string
+	Name        string            // without the leading slash
+	Labels      map[string]string // docker labels, the container rules of the policy select containers by them
+	Endpoints   []Endpoint        // one per network the container is attached to, sorted by network name
+	Ports       []types.Port
+	Access      []ContainerAccess // from the firewall.* labels and the container rules of the policy
+}
+
+// ContainerAccess is access to the published ports of a container, declared by its firewall.*
+// labels or by a container rule of the policy
+type ContainerAccess struct {
+	Allow   []string // policy groups or hosts allowed to the ports
+	Public  bool     // the ports are open to everyone
+	Ports   []Port   // container ports the access applies to, every published port when empty
+	Sources []string // addresses Allow resolves to
+}
+
+// ContainerRule is a rule of the policy giving access to the containers it selects
+type ContainerRule struct {
+	Containers []string // container names or label=value selectors
+	Access     ContainerAccess
 }
 
-// EndpointSettings stores the network endpoint details
-type NetworkMetaData struct {
-	NetworkID string
-	Name      string
+// Selects reports whether selector, a container name or a label=value pair, matches the container
+func (c ContainerInfo) Selects(selector string) bool {
+	if label, value, found := strings.Cut(selector, "="); found {
+		actual, set := c.Labels[label]
+		return set && actual == value
+	}
+	return c.Name == selector
+}
+
+// AccessPorts returns the published ports access gives access to, they are matched on the port
+// inside the container so remapping the host port keeps the access
+func (c ContainerInfo) AccessPorts(access ContainerAccess) []types.Port {
+	if !access.Public && len(access.Sources) == 0 {
+		return nil
+	}
+	var ports []types.Port
+	for _, port := range c.Ports {
+		if len(access.Ports) == 0 || slices.ContainsFunc(access.Ports, func(p Port) bool { return p.MatchesPrivate(port) }) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// ForwardRule lets a source reach a published port of a container on one of its networks
+type ForwardRule struct {
+	Source   string // an address, a prefix or the set holding them, empty for everyone
+	Comment  string // comment match naming the hostname of Source
+	Endpoint Endpoint
+	Port     types.Port
+}
+
+// RuleSection is a commented group of the container rules of a ruleset
+type RuleSection struct {
+	Comment string
+	Rules   []ForwardRule
+}
+
+// add appends the rule letting source reach port on endpoint
+func (s *RuleSection) add(source, comment string, endpoint Endpoint, port types.Port) {
+	s.Rules = append(s.Rules, ForwardRule{Source: source, Comment: comment, Endpoint: endpoint, Port: port})
+}
+
+// ForwardSections returns the rules giving the admins, the entities, the authorized hosts and the
+// labels and policy rules of the containers access to their published ports, every backend
+// formats the same sections
+func (d Data) ForwardSections() []RuleSection {
+	admins := RuleSection{Comment: "allow all admins to containers"}
+	entities := RuleSection{Comment: "allow specific entities to containers"}
+	authorized := RuleSection{Comment: "allow specific hosts to containers"}
+	declared := RuleSection{Comment: "allow the access declared by container labels and policy rules"}
+	hosts := make([]string, 0, len(d.MappedData))
+	for ip := range d.MappedData {
+		hosts = append(hosts, ip)
+	}
+	slices.Sort(hosts)
+	for _, container := range d.ContainerInfos {
+		for _, endpoint := range container.Endpoints {
+			for _, port := range container.Ports {
+				for _, admin := range d.Admins {
+					admins.add(admin.Source, admin.Comment(), endpoint, port)
+				}
+				for _, domain := range d.EntityDomains {
+					for _, domainPort := range domain.PortsArr {
+						if !domainPort.Matches(port) {
+							continue
+						}
+						for _, ip := range domain.IPs {
+							entities.add(ip, d.HostComment(ip), endpoint, port)
+						}
+					}
+				}
+				for _, ip := range hosts {
+					for _, hostPort := range d.MappedData[ip] {
+						if hostPort.Matches(port) {
+							authorized.add(ip, d.HostComment(ip), endpoint, port)
+						}
+					}
+				}
+			}
+			for _, access := range container.Access {
+				for _, port := range container.AccessPorts(access) {
+					if access.Public {
+						declared.add("", "", endpoint, port)
+						continue
+					}
+					for _, ip := range access.Sources {
+						declared.add(ip, d.HostComment(ip), endpoint, port)
+					}
+				}
+			}
+		}
+	}
+	return []RuleSection{admins, entities, authorized, declared}
+}
+
+// Endpoint stores the container details on one of its networks
+type Endpoint struct {
+	NetworkID   string
+	NetworkName string
+	Bridge      string // host interface of the network bridge, docker0 for the default bridge network
+	IPAddress   string
+	Subnet      string
+	IPv6Address string // empty when ipv6 is not enabled on the network
+	IPv6Subnet  string
 }
 
 type AccessDomain struct {
 	Name     string
 	Ports    string
-	PortsArr []int
-	IP       string
+	PortsArr []Port
+	IPs      []string // every address the host resolved to, ipv4 and ipv6
+}
+
+// PortsByProto returns the ports of the domain joined by protocol for iptables
+func (d AccessDomain) PortsByProto() map[string]string {
+	return GroupPorts(d.PortsArr, ":")
+}
+
+// Port is a port or a port range of an access file with its protocol, written 53/udp or 8000-8100,
+// tcp when no protocol is given
+type Port struct {
+	Number uint16
+	End    uint16 // last port of a range, 0 for a single port
+	Proto  string // tcp, udp or sctp, the names used by docker, iptables and nft alike
+}
+
+// Range returns the port, or the range with sep between its bounds, 8000:8100 for iptables and 8000-8100 for nft
+func (p Port) Range(sep string) string {
+	if p.End == 0 {
+		return strconv.Itoa(int(p.Number))
+	}
+	return strconv.Itoa(int(p.Number)) + sep + strconv.Itoa(int(p.End))
+}
+
+// String returns the port as written in the access files
+func (p Port) String() string {
+	if p.Proto == "tcp" {
+		return p.Range("-")
+	}
+	return p.Range("-") + "/" + p.Proto
+}
+
+// Matches reports whether a port published by a container is this port or is in this range
+func (p Port) Matches(port types.Port) bool {
+	return p.Proto == port.Type && p.contains(port.PublicPort)
+}
+
+// MatchesPrivate reports whether the container side of a published port is this port or is in this range
+func (p Port) MatchesPrivate(port types.Port) bool {
+	return p.Proto == port.Type && p.contains(port.PrivatePort)
+}
+
+// contains reports whether number is this port or is in this range
+func (p Port) contains(number uint16) bool {
+	if p.End == 0 {
+		return p.Number == number
+	}
+	return p.Number <= number && number <= p.End
+}
+
+// GroupPorts joins ports by protocol in their original order for multiport matches, with sep
+// between the bounds of ranges, {"tcp": "80,443,8000:8100", "udp": "53"}
+func GroupPorts(ports []Port, sep string) map[string]string {
+	numbers := make(map[string][]string)
+	for _, port := range ports {
+		numbers[port.Proto] = append(numbers[port.Proto], port.Range(sep))
+	}
+	grouped := make(map[string]string)
+	for proto, list := range numbers {
+		grouped[proto] = strings.Join(list, ",")
+	}
+	return grouped
 }
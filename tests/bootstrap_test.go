@@ -0,0 +1,32 @@
+package tests
+
+import (
+	"firewall_script_docker/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBootstrap(t *testing.T) {
+	cfg := config.Default()
+	cfg.RelativePath = filepath.Join(t.TempDir(), "firewall")
+	cfg.AdminFilePath = filepath.Join(cfg.RelativePath, "admin_access_domains.txt")
+	cfg.EntityFilePath = filepath.Join(cfg.RelativePath, "entity_access_domains.txt")
+	cfg.IpsPath = filepath.Join(cfg.RelativePath, "authorized_access_ips.txt")
+	cfg.PublicPortPath = filepath.Join(cfg.RelativePath, "public_ports.txt")
+
+	created, err := config.Bootstrap(cfg, true)
+	if err != nil || len(created) != 5 {
+		t.Fatalf("Bootstrap(dry run) = %v, %v; want the directory and 4 files", created, err)
+	}
+	if _, err := os.Stat(cfg.RelativePath); !os.IsNotExist(err) {
+		t.Errorf("Bootstrap(dry run) created %s", cfg.RelativePath)
+	}
+
+	if created, err = config.Bootstrap(cfg, false); err != nil || len(created) != 5 {
+		t.Fatalf("Bootstrap() = %v, %v; want the directory and 4 files", created, err)
+	}
+	if created, err = config.Bootstrap(cfg, false); err != nil || len(created) != 0 {
+		t.Errorf("second Bootstrap() = %v, %v; want nothing created", created, err)
+	}
+}
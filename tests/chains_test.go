@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+)
+
+const chainsRules = `*filter
+:FIREWALL-INPUT - [0:0]
+:FIREWALL-FORWARD - [0:0]
+-A INPUT -j FIREWALL-INPUT
+-I DOCKER-USER -j FIREWALL-FORWARD
+-A FIREWALL-INPUT -i lo -j ACCEPT
+COMMIT
+`
+
+const chainsLiveRules = `*filter
+:INPUT ACCEPT [0:0]
+:DOCKER-USER - [0:0]
+:FIREWALL-INPUT - [0:0]
+-A INPUT -s 6.6.6.6/32 -j REJECT
+[3:120] -A INPUT -j FIREWALL-INPUT
+-A DOCKER-USER -j RETURN
+-A FIREWALL-INPUT -s 9.9.9.9/32 -j ACCEPT
+COMMIT
+`
+
+func TestApplyRulesChainsMode(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesMode = utils.ModeChains
+	cfg.IptablesRulesFile = filepath.Join(dir, "GENERATED_IPTABLES_RULES.rules")
+	cfg.IptablesSaveBinary = filepath.Join(dir, "iptables-save")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	restored := filepath.Join(dir, "restored")
+	os.WriteFile(cfg.IptablesRulesFile, []byte(chainsRules), 0644)
+	os.WriteFile(filepath.Join(dir, "live"), []byte(chainsLiveRules), 0644)
+	os.WriteFile(cfg.IptablesSaveBinary, []byte("#!/bin/sh\ncat "+filepath.Join(dir, "live")+"\n"), 0755)
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte("#!/bin/sh\necho \"$@\" >"+restored+"\ncat >>"+restored+"\n"), 0755)
+
+	if _, err := utils.ApplyRules(cfg); err != nil {
+		t.Fatalf("ApplyRules() = %v", err)
+	}
+	content, _ := os.ReadFile(restored)
+	args, rules, _ := strings.Cut(string(content), "\n")
+	if args != "--noflush" {
+		t.Errorf("iptables-restore arguments = %q; want --noflush", args)
+	}
+	if strings.Contains(rules, "-A INPUT -j FIREWALL-INPUT") || !strings.Contains(rules, "-I DOCKER-USER -j FIREWALL-FORWARD") {
+		t.Errorf("restored rules =\n%s\nwant the DOCKER-USER jump only, the INPUT jump is live", rules)
+	}
+}
+
+func TestDiffRulesetsChainsMode(t *testing.T) {
+	diffs := utils.DiffRulesets(chainsLiveRules, chainsRules, true)
+	if len(diffs) != 3 {
+		t.Fatalf("DiffRulesets() = %v; want DOCKER-USER, FIREWALL-FORWARD and FIREWALL-INPUT", diffs)
+	}
+	if diffs[0].Chain != "DOCKER-USER" || len(diffs[0].Removed) != 0 || len(diffs[0].Added) != 1 {
+		t.Errorf("DiffRulesets()[0] = %+v; want the missing jump only", diffs[0])
+	}
+	if diffs[1].Chain != "FIREWALL-FORWARD" || diffs[1].LivePolicy != "" {
+		t.Errorf("DiffRulesets()[1] = %+v; want the new FIREWALL-FORWARD chain", diffs[1])
+	}
+	if diffs[2].Chain != "FIREWALL-INPUT" || len(diffs[2].Removed) != 1 || len(diffs[2].Added) != 1 {
+		t.Errorf("DiffRulesets()[2] = %+v; want the 9.9.9.9 rule replaced", diffs[2])
+	}
+}
+
+func TestDiffRulesetsDockerUserMode(t *testing.T) {
+	live := "*filter\n:INPUT ACCEPT [0:0]\n:DOCKER - [0:0]\n:DOCKER-USER - [0:0]\n-A INPUT -s 6.6.6.6/32 -j REJECT\n-A DOCKER -d 172.17.0.2/32 -p tcp -m tcp --dport 80 -j ACCEPT\n-A DOCKER-USER -j RETURN\nCOMMIT\n"
+	generated := "*filter\n:INPUT DROP [0:0]\n:DOCKER-USER - [0:0]\n-F INPUT\n-A INPUT -i lo -j ACCEPT\n-A DOCKER-USER -j RETURN\nCOMMIT\n"
+	diffs := utils.DiffRulesets(live, generated, true)
+	if len(diffs) != 1 {
+		t.Fatalf("DiffRulesets() = %v; want INPUT only, the DOCKER chain belongs to dockerd", diffs)
+	}
+	input := diffs[0]
+	if input.Chain != "INPUT" || input.Policy != "DROP" || len(input.Removed) != 1 || len(input.Added) != 1 {
+		t.Errorf("DiffRulesets()[0] = %+v; want the INPUT policy and rules replaced", input)
+	}
+}
+
+func TestGenerateIPTablesChainsIPv6DockerUser(t *testing.T) {
+	container := structs.ContainerInfo{
+		ContainerID: "web",
+		Ports:       []types.Port{{PrivatePort: 80, PublicPort: 8080, Type: "tcp"}},
+		Endpoints:   []structs.Endpoint{{Bridge: "docker0", IPAddress: "fd00::2", Subnet: "fd00::/64"}},
+	}
+	tests := []struct {
+		name       string
+		dockerUser bool
+		containers []structs.ContainerInfo
+		want       bool
+	}{
+		{"no docker chains", false, nil, false},
+		{"docker chains", true, nil, true},
+		{"ipv6 container without docker chains", false, []structs.ContainerInfo{container}, false},
+		{"ipv6 container", true, []structs.ContainerInfo{container}, true},
+	}
+	for _, tt := range tests {
+		data := structs.Data{
+			Admins:          []structs.Admin{{Source: "2001:db8::1"}},
+			DockerInstalled: true,
+			IPv6:            true,
+			IPv6DockerUser:  tt.dockerUser,
+			ContainerInfos:  tt.containers,
+		}
+		rules, err := utils.GenerateIPTablesChains(data)
+		if err != nil {
+			t.Fatalf("%s: GenerateIPTablesChains() = %v", tt.name, err)
+		}
+		for _, line := range []string{":FIREWALL-FORWARD - [0:0]", "-I DOCKER-USER -j FIREWALL-FORWARD"} {
+			if got := strings.Contains(rules, line); got != tt.want {
+				t.Errorf("%s: rules contain %q = %v; want %v\n%s", tt.name, line, got, tt.want, rules)
+			}
+		}
+	}
+}
+
+func TestHasIPv6DockerUser(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Ip6tablesSaveBinary = filepath.Join(dir, "ip6tables-save")
+	os.WriteFile(filepath.Join(dir, "live"), []byte(chainsLiveRules), 0644)
+	os.WriteFile(cfg.Ip6tablesSaveBinary, []byte("#!/bin/sh\ncat "+filepath.Join(dir, "live")+"\n"), 0755)
+	if !utils.HasIPv6DockerUser(cfg) {
+		t.Errorf("HasIPv6DockerUser() = false; want true, the live rules declare DOCKER-USER")
+	}
+	os.WriteFile(filepath.Join(dir, "live"), []byte("*filter\n:INPUT ACCEPT [0:0]\nCOMMIT\n"), 0644)
+	if utils.HasIPv6DockerUser(cfg) {
+		t.Errorf("HasIPv6DockerUser() = true; want false without docker chains")
+	}
+}
@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"errors"
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"strings"
+	"testing"
+)
+
+func TestGenerateRulesFromFixture(t *testing.T) {
+	source, err := utils.LoadFixtureSource("testfiles/docker/topology.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	containers, err := utils.GetContainerInfos(source)
+	if err != nil {
+		t.Fatalf("GetContainerInfos() = %v", err)
+	}
+	if len(containers) != 3 || len(containers[2].Endpoints) != 0 {
+		t.Fatalf("GetContainerInfos() = %+v; want 3 containers, the host network one without endpoint", containers)
+	}
+
+	data := structs.Data{
+		Admins:          []structs.Admin{{Source: "1.1.1.1"}},
+		DockerInstalled: true,
+		ContainerInfos:  containers,
+		MappedData:      map[string][]structs.Port{"5.5.5.5": {{Number: 5432, Proto: "tcp"}}},
+	}
+	data.MappedData2 = utils.FilterPortsArray(data.MappedData, utils.UniquePublicPorts(containers))
+	data.UniqueNetworkIDs = utils.GetUniqueNetworkIDs(containers)
+
+	rules, err := utils.GenerateRules(config.Default(), data)
+	if err != nil {
+		t.Fatalf("GenerateRules() = %v", err)
+	}
+	for _, rule := range []string{
+		"-A DOCKER ! -i docker0 -p tcp -m tcp --dport 8080 -j DNAT --to-destination 172.17.0.2:80",
+		// the backend network has no ipam config, its bridge is still named after its id
+		"-A DOCKER -s 5.5.5.5 -d 172.18.0.2/32 ! -i br-3f0c9a8b7d6e -o br-3f0c9a8b7d6e -p tcp -m tcp --dport 5432 -j ACCEPT",
+	} {
+		if !strings.Contains(rules.Rules, rule+"\n") {
+			t.Errorf("Rules =\n%s\nwant %q", rules.Rules, rule)
+		}
+	}
+}
+
+func TestGetContainerInfosUnknownNetwork(t *testing.T) {
+	source, err := utils.LoadFixtureSource("testfiles/docker/topology.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	source.Networks = nil
+
+	_, err = utils.GetContainerInfos(source)
+	var dockerErr *utils.DockerError
+	if !errors.As(err, &dockerErr) || !strings.HasPrefix(dockerErr.Op, "inspecting network") {
+		t.Errorf("GetContainerInfos() = %v; want a DockerError inspecting the network", err)
+	}
+}
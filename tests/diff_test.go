@@ -0,0 +1,58 @@
+package tests
+
+import (
+	"firewall_script_docker/utils"
+	"slices"
+	"testing"
+)
+
+const liveRules = `# Generated by iptables-save v1.8.7 on Sun Oct 18 10:00:00 2026
+*mangle
+:PREROUTING ACCEPT [10:1000]
+COMMIT
+*filter
+:INPUT ACCEPT [120:9000]
+:FORWARD DROP [0:0]
+:OUTPUT DROP [0:0]
+[5:300] -A INPUT -m conntrack --ctstate ESTABLISHED -j ACCEPT
+-A INPUT -s 1.1.1.1/32 -p tcp -m state --state NEW -m tcp -j ACCEPT
+-A INPUT -s 2.2.2.2/32 -p tcp -m state --state NEW -m tcp -j ACCEPT
+-A INPUT -p tcp -m state --state NEW -m tcp -m multiport --dports 80,443 -m comment --comment "public web" -j ACCEPT
+-A INPUT -s 9.9.9.9/32 -p tcp -m state --state NEW -m tcp --dport 22 -j ACCEPT
+COMMIT
+`
+
+const generatedRules = `# Generated on now
+*filter
+:INPUT DROP [0:0]
+:FORWARD DROP [0:0]
+:OUTPUT DROP [0:0]
+:DOCKER - [0:0]
+
+#ADMIN RULES
+-A INPUT -s 1.1.1.1,2.2.2.2 -p tcp -m state --state NEW -m tcp -j ACCEPT
+-A INPUT -m state --state NEW -p tcp -m tcp -m multiport --dports 80,443 -j ACCEPT
+-A INPUT -m conntrack --ctstate ESTABLISHED -j ACCEPT
+-A INPUT -s 4.4.4.4 -p udp -m state --state NEW -m udp --dport 53 -j ACCEPT
+COMMIT
+`
+
+func TestDiffRulesets(t *testing.T) {
+	diffs := utils.DiffRulesets(liveRules, generatedRules, false)
+	if len(diffs) != 2 {
+		t.Fatalf("DiffRulesets() = %v; want the DOCKER and INPUT chains only", diffs)
+	}
+	if diffs[0].Chain != "DOCKER" || diffs[0].LivePolicy != "" || diffs[0].Policy != "-" {
+		t.Errorf("DiffRulesets()[0] = %+v; want the new DOCKER chain", diffs[0])
+	}
+	input := diffs[1]
+	if input.Chain != "INPUT" || input.LivePolicy != "ACCEPT" || input.Policy != "DROP" {
+		t.Errorf("DiffRulesets()[1] = %+v; want the INPUT policy change", input)
+	}
+	if !slices.Equal(input.Removed, []string{"-A INPUT -s 9.9.9.9/32 -p tcp -m state --state NEW -m tcp --dport 22 -j ACCEPT"}) {
+		t.Errorf("Removed = %v; want the 9.9.9.9 rule only", input.Removed)
+	}
+	if !slices.Equal(input.Added, []string{"-A INPUT -s 4.4.4.4/32 -p udp -m state --state NEW -m udp --dport 53 -j ACCEPT"}) {
+		t.Errorf("Added = %v; want the 4.4.4.4 rule only", input.Added)
+	}
+}
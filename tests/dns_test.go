@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"encoding/binary"
+	"firewall_script_docker/utils"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsResponse returns a response to the A query of www.example.com listing count answers, answers
+// appends their records
+func dnsResponse(id, flags, count uint16, answers func(msg []byte) []byte) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = append(msg, 0, 1)
+	msg = binary.BigEndian.AppendUint16(msg, count)
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, "\x03www\x07example\x03com\x00"...)
+	msg = append(msg, 0, 1, 0, 1)
+	return answers(msg)
+}
+
+// dnsRecord appends a record named by the compression pointer name
+func dnsRecord(msg []byte, name int, rtype uint16, ttl uint32, data []byte) []byte {
+	msg = append(msg, 0xC0|byte(name>>8), byte(name))
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = append(msg, 0, 1)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// cnameChain answers www.example.com CNAME web.example.com with an A and an AAAA record of web
+func cnameChain(msg []byte) []byte {
+	msg = dnsRecord(msg, 12, 5, 300, []byte("\x03web\xC0\x10"))
+	web := len(msg) - 6
+	msg = dnsRecord(msg, web, 1, 60, []byte{192, 0, 2, 1})
+	return dnsRecord(msg, web, 28, 120, []byte{0x20, 0x01, 0x0d, 0xb8, 15: 1})
+}
+
+func TestParseDNSAnswer(t *testing.T) {
+	msg := dnsResponse(7, 0x8180, 3, cnameChain)
+	addresses, ttl, err := utils.ParseDNSAnswer(msg, 7)
+	if err != nil || !slices.Equal(addresses, []string{"192.0.2.1", "2001:db8::1"}) || ttl != time.Minute {
+		t.Errorf("ParseDNSAnswer() = %v, %s, %v; want the addresses at the end of the cname chain and the lowest ttl", addresses, ttl, err)
+	}
+
+	if _, _, err := utils.ParseDNSAnswer(msg, 8); err == nil {
+		t.Error("ParseDNSAnswer() = nil; want an error for the response to another query")
+	}
+	truncated := dnsResponse(7, 0x8380, 0, func(msg []byte) []byte { return msg })
+	if _, _, err := utils.ParseDNSAnswer(truncated, 7); err == nil || !strings.Contains(err.Error(), "truncated") {
+		t.Errorf("ParseDNSAnswer() = %v; want the truncated error so the query is sent again over tcp", err)
+	}
+	nxdomain := dnsResponse(7, 0x8183, 0, func(msg []byte) []byte { return msg })
+	if _, _, err := utils.ParseDNSAnswer(nxdomain, 7); err == nil {
+		t.Error("ParseDNSAnswer() = nil; want an error for the nxdomain response code")
+	}
+	for name, malformed := range map[string][]byte{
+		"short header":        msg[:10],
+		"cut in a record":     msg[:len(msg)-20],
+		"cut in the data":     msg[:len(msg)-4],
+		"more answers listed": dnsResponse(7, 0x8180, 4, cnameChain),
+		"cut in a pointer":    dnsResponse(7, 0x8180, 1, func(msg []byte) []byte { return append(msg, 0xC0) }),
+	} {
+		if _, _, err := utils.ParseDNSAnswer(malformed, 7); err == nil {
+			t.Errorf("ParseDNSAnswer(%s) = nil; want an error for the malformed response", name)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package tests
+
+import (
+	"errors"
+	"firewall_script_docker/utils"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/client"
+)
+
+func TestGetContainerInfosDockerError(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	cli, err := client.NewClientWithOpts(client.WithHost("unix://"+socket), client.WithVersion("1.43"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	containers, err := utils.GetContainerInfos(cli)
+	var dockerErr *utils.DockerError
+	if !errors.As(err, &dockerErr) {
+		t.Fatalf("GetContainerInfos() = %v, %v; want a DockerError", containers, err)
+	}
+	if dockerErr.Op != "listing containers" {
+		t.Errorf("Op = %q; want %q", dockerErr.Op, "listing containers")
+	}
+}
+
+func TestAccessFileErrors(t *testing.T) {
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing.txt")
+	if admins, err := utils.GetAdmins(missing); admins != nil || err != nil {
+		t.Errorf("GetAdmins(missing) = %v, %v; want no admins and no error", admins, err)
+	}
+	if ports, _, err := utils.GetPublicPorts(missing); ports != "" || err != nil {
+		t.Errorf("GetPublicPorts(missing) = %q, %v; want no ports and no error", ports, err)
+	}
+
+	// a directory opens but can't be read
+	if _, err := utils.GetAdmins(dir); err == nil {
+		t.Errorf("GetAdmins(dir) = nil error; want the read error")
+	}
+	if _, err := utils.ProcessDomainFile(dir); err == nil {
+		t.Errorf("ProcessDomainFile(dir) = nil error; want the read error")
+	}
+	if _, _, err := utils.ProcessAuthorizedAccessFile(dir); err == nil {
+		t.Errorf("ProcessAuthorizedAccessFile(dir) = nil error; want the read error")
+	}
+	if _, _, err := utils.GetPublicPorts(dir); err == nil {
+		t.Errorf("GetPublicPorts(dir) = nil error; want the read error")
+	}
+}
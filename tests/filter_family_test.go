@@ -0,0 +1,39 @@
+package tests
+
+import (
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"slices"
+	"testing"
+)
+
+func TestFilterFamily(t *testing.T) {
+	data := structs.Data{
+		Admins: []structs.Admin{{Source: "1.1.1.1"}, {Source: "2001:db8::1"}},
+		ContainerInfos: []structs.ContainerInfo{{
+			ContainerID: "db",
+			Endpoints: []structs.Endpoint{
+				{NetworkName: "bridge", Bridge: "docker0", IPAddress: "172.17.0.2", Subnet: "172.17.0.0/16"},
+				{NetworkName: "backend", Bridge: "br-222", IPAddress: "172.18.0.2", Subnet: "172.18.0.0/16", IPv6Address: "fd00::2", IPv6Subnet: "fd00::/64"},
+			},
+		}},
+		MappedData: map[string][]structs.Port{"4.4.4.4": {{Number: 22, Proto: "tcp"}}, "2001:db8::4": {{Number: 22, Proto: "tcp"}}},
+	}
+
+	v4 := utils.FilterFamily(data, false)
+	if !slices.Equal(v4.AdminSources(), []string{"1.1.1.1"}) || len(v4.MappedData) != 1 || v4.DefaultBridgeSubnet != "172.17.0.0/16" {
+		t.Errorf("FilterFamily(ipv4) = %v, %v, %q; want the ipv4 admins, ips and docker0 subnet", v4.Admins, v4.MappedData, v4.DefaultBridgeSubnet)
+	}
+
+	v6 := utils.FilterFamily(data, true)
+	if !slices.Equal(v6.AdminSources(), []string{"2001:db8::1"}) || len(v6.MappedData) != 1 || v6.DefaultBridgeSubnet != "" {
+		t.Errorf("FilterFamily(ipv6) = %v, %v, %q; want the ipv6 admins and ips only", v6.Admins, v6.MappedData, v6.DefaultBridgeSubnet)
+	}
+	endpoints := v6.ContainerInfos[0].Endpoints
+	if len(endpoints) != 1 || endpoints[0].IPAddress != "fd00::2" || endpoints[0].Subnet != "fd00::/64" {
+		t.Errorf("FilterFamily(ipv6) endpoints = %+v; want the ipv6 address of br-222 only", endpoints)
+	}
+	if v6.DNATAddress("fd00::2") != "[fd00::2]" || v4.DNATAddress("172.18.0.2") != "172.18.0.2" {
+		t.Errorf("DNATAddress does not bracket ipv6 addresses only")
+	}
+}
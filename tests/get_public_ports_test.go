@@ -1,13 +1,65 @@
 package tests
 
 import (
+	"firewall_script_docker/structs"
 	"firewall_script_docker/utils"
+	"os"
+	"path/filepath"
+	"slices"
 	"testing"
 )
 
 func TestGetPublicPorts(t *testing.T) {
-	ports, hasPorts := utils.GetPublicPorts("./testfiles/ports")
-	if ports != "80,90" || !hasPorts {
+	ports, hasPorts, err := utils.GetPublicPorts("./testfiles/ports")
+	if ports != "80,90" || !hasPorts || err != nil {
 		t.Errorf("TestGetPublicPorts(-1) = %s; want 80,90", ports)
 	}
 }
+
+func TestParsePorts(t *testing.T) {
+	ports := utils.ParsePorts("80, 53/udp,51820/UDP,80,0,70000,22/icmp,mama,8000-8100,60000-61000/udp,9-9,20-10")
+	want := []structs.Port{
+		{Number: 80, Proto: "tcp"},
+		{Number: 53, Proto: "udp"},
+		{Number: 51820, Proto: "udp"},
+		{Number: 8000, End: 8100, Proto: "tcp"},
+		{Number: 60000, End: 61000, Proto: "udp"},
+		{Number: 9, Proto: "tcp"},
+	}
+	if !slices.Equal(ports, want) {
+		t.Errorf("ParsePorts() = %v; want %v", ports, want)
+	}
+}
+
+func TestGetAdminsCIDR(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "admin_access_domains.txt")
+	os.WriteFile(filePath, []byte("10.1.2.3/8\n192.168.1.1\n2001:db8::/32\nnot a host\nlocalhost\n"), 0644)
+	admins, _ := utils.GetAdmins(filePath)
+	want := []structs.Admin{{Source: "10.0.0.0/8"}, {Source: "192.168.1.1"}, {Source: "2001:db8::/32"}}
+	if len(admins) < len(want) || !slices.Equal(admins[:len(want)], want) {
+		t.Errorf("GetAdmins() = %v; want %v first", admins, want)
+	}
+	if !slices.Contains(admins, structs.Admin{Source: "127.0.0.1", Host: "localhost"}) {
+		t.Errorf("GetAdmins() = %v; want 127.0.0.1 resolved from localhost", admins)
+	}
+}
+
+func TestProcessAccessFilesHostNames(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "access.txt")
+	os.WriteFile(filePath, []byte("localhost:80\n127.0.0.1:443\n5.5.5.5:22\n"), 0644)
+
+	domains, _ := utils.ProcessDomainFile(filePath)
+	if len(domains) != 2 || domains[0].Name != "localhost" || !slices.Contains(domains[0].IPs, "127.0.0.1") || domains[1].Name != "5.5.5.5" {
+		t.Errorf("ProcessDomainFile() = %+v; want localhost with all its addresses and 5.5.5.5, 127.0.0.1 is already listed", domains)
+	} else if len(domains[0].PortsArr) != 2 || domains[0].Ports != "80,443" {
+		t.Errorf("ProcessDomainFile() localhost ports = %q %v; want the port of 127.0.0.1 added to 80", domains[0].Ports, domains[0].PortsArr)
+	}
+
+	ipsByPort, hostNames, _ := utils.ProcessAuthorizedAccessFile(filePath)
+	if len(ipsByPort["127.0.0.1"]) != 2 || hostNames["127.0.0.1"] != "localhost" {
+		t.Errorf("ProcessAuthorizedAccessFile() = %v, %v; want 127.0.0.1 with both ports from localhost", ipsByPort, hostNames)
+	}
+	if _, found := hostNames["5.5.5.5"]; found {
+		t.Errorf("hostNames[5.5.5.5] = %q; want none for an ip", hostNames["5.5.5.5"])
+	}
+}
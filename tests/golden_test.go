@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files of testfiles/golden")
+
+// goldenData completes data the way collectData does with the containers of a docker fixture,
+// an empty topology renders the ruleset of a host without docker
+func goldenData(t *testing.T, topology string, data structs.Data) structs.Data {
+	t.Helper()
+	data.PublicPortMetaData.HasPublicPorts = data.PublicPortMetaData.PublicPorts != ""
+	data.PublicPortMetaData.Ports = utils.ParsePorts(data.PublicPortMetaData.PublicPorts)
+	if topology != "" {
+		source, err := utils.LoadFixtureSource(filepath.Join("testfiles/docker", topology))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.ContainerInfos, err = utils.GetContainerInfos(source); err != nil {
+			t.Fatal(err)
+		}
+		data.HostNames = utils.ResolveContainerAccess(data.ContainerInfos, data.Groups, data.ContainerRules)
+		data.DockerInstalled = true
+	}
+	data.MappedData2 = utils.FilterPortsArray(data.MappedData, utils.UniquePublicPorts(data.ContainerInfos))
+	data.UniqueNetworkIDs = utils.GetUniqueNetworkIDs(data.ContainerInfos)
+	return data
+}
+
+// goldenRenderers render the rulesets compared to the golden files, named after the case and
+// the suffix. The iptables modes are rendered for ipv4, nftables holds both families.
+var goldenRenderers = []struct {
+	suffix string
+	render func(data structs.Data) (string, error)
+}{
+	{".tables.rules", func(data structs.Data) (string, error) {
+		return utils.GenerateIPTablesRules(utils.FilterFamily(data, false))
+	}},
+	{".chains.rules", func(data structs.Data) (string, error) {
+		return utils.GenerateIPTablesChains(utils.FilterFamily(data, false))
+	}},
+	{".docker-user.rules", func(data structs.Data) (string, error) {
+		return utils.GenerateIPTablesDockerUser(utils.FilterFamily(data, false))
+	}},
+	{".nft", utils.GenerateNftablesRules},
+}
+
+func TestGenerateRulesGolden(t *testing.T) {
+	partner := structs.AccessDomain{Name: "partner.example.com", IPs: []string{"5.5.5.5", "5.5.5.6"}, PortsArr: []structs.Port{{Number: 443, Proto: "tcp"}, {Number: 5432, Proto: "tcp"}}}
+	authorized := map[string][]structs.Port{
+		"5.5.5.5":     {{Number: 5432, Proto: "tcp"}},
+		"10.8.0.0/24": {{Number: 22, Proto: "tcp"}, {Number: 80, Proto: "tcp"}},
+	}
+	tests := []struct {
+		name     string
+		topology string
+		data     structs.Data
+	}{
+		{
+			name: "no-docker",
+			data: structs.Data{
+				Admins:             []structs.Admin{{Source: "1.1.1.1"}, {Source: "2.2.2.0/24"}},
+				EntityDomains:      []structs.AccessDomain{partner},
+				MappedData:         authorized,
+				PublicPortMetaData: structs.PublicPortMetaData{PublicPorts: "80,443,53/udp"},
+			},
+		},
+		{
+			name:     "bridge-only",
+			topology: "bridge.json",
+			data: structs.Data{
+				Admins:             []structs.Admin{{Source: "1.1.1.1"}},
+				PublicPortMetaData: structs.PublicPortMetaData{PublicPorts: "22"},
+			},
+		},
+		{
+			name:     "custom-networks",
+			topology: "topology.json",
+			data: structs.Data{
+				Admins:     []structs.Admin{{Source: "1.1.1.1"}, {Source: "3.3.3.3", Host: "admin.example.com"}},
+				MappedData: authorized,
+			},
+		},
+		{
+			// 5.5.5.5 is both a partner address and authorized on its own to the database
+			name:     "entity-authorized-overlap",
+			topology: "topology.json",
+			data: structs.Data{
+				Admins:        []structs.Admin{{Source: "1.1.1.1"}},
+				EntityDomains: []structs.AccessDomain{partner},
+				MappedData:    authorized,
+			},
+		},
+		{
+			// app allows the office group and a host to its port 443 only, status is public
+			name:     "container-labels",
+			topology: "labels.json",
+			data: structs.Data{
+				Admins: []structs.Admin{{Source: "1.1.1.1"}},
+				Groups: map[string][]string{"office": {"10.20.0.0/16", "198.51.100.4"}},
+			},
+		},
+		{
+			// the policy opens port 9000 of the app service to the office and every port of status
+			// to a monitoring host, next to the labels of both containers
+			name:     "container-rules",
+			topology: "labels.json",
+			data: structs.Data{
+				Admins: []structs.Admin{{Source: "1.1.1.1"}},
+				Groups: map[string][]string{"office": {"10.20.0.0/16"}, "monitoring": {"192.0.2.50"}},
+				ContainerRules: []structs.ContainerRule{
+					{Containers: []string{"com.docker.compose.service=app"}, Access: structs.ContainerAccess{Allow: []string{"office"}, Ports: []structs.Port{{Number: 9000, Proto: "tcp"}}}},
+					{Containers: []string{"status", "missing"}, Access: structs.ContainerAccess{Allow: []string{"monitoring"}}},
+				},
+			},
+		},
+		{
+			name:     "no-admins",
+			topology: "topology.json",
+			data: structs.Data{
+				EntityDomains:      []structs.AccessDomain{partner},
+				PublicPortMetaData: structs.PublicPortMetaData{PublicPorts: "8080"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := goldenData(t, tt.topology, tt.data)
+			for _, renderer := range goldenRenderers {
+				rules, err := renderer.render(data)
+				if err != nil {
+					t.Fatalf("rendering %s = %v", renderer.suffix, err)
+				}
+				golden := filepath.Join("testfiles/golden", tt.name+renderer.suffix)
+				if *update {
+					if err := os.WriteFile(golden, []byte(rules), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				want, err := os.ReadFile(golden)
+				if err != nil {
+					t.Fatalf("%v, run go test ./tests -run Golden -update to create it", err)
+				}
+				if rules != string(want) {
+					t.Errorf("the ruleset differs from %s, run go test ./tests -run Golden -update and review the diff\ngot:\n%s", golden, rules)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package tests
+
+import (
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func ipsetData(partners ...string) structs.Data {
+	data := structs.Data{Admins: []structs.Admin{{Source: "1.1.1.1"}, {Source: "2001:db8::1"}}}
+	for _, partner := range partners {
+		data.EntityDomains = append(data.EntityDomains, structs.AccessDomain{Name: partner, IPs: []string{partner}, PortsArr: []structs.Port{{Number: 443, Proto: "tcp"}}})
+	}
+	return data
+}
+
+func TestGenerateRulesWithIPSets(t *testing.T) {
+	cfg := config.Default()
+	cfg.IpsetBinary = "/usr/sbin/ipset"
+
+	rules, err := utils.GenerateRules(cfg, ipsetData("5.5.5.5", "6.6.6.6"))
+	if err != nil {
+		t.Fatalf("GenerateRules() = %v", err)
+	}
+	if !strings.Contains(rules.Rules, "-A INPUT -m set --match-set fw-admins src -p tcp") || strings.Contains(rules.Rules, "5.5.5.5") {
+		t.Errorf("Rules =\n%s\nwant the admins and entities matched by set", rules.Rules)
+	}
+	if strings.Count(rules.Rules, "--match-set fw-ent-") != 1 {
+		t.Errorf("Rules =\n%s\nwant one rule for the entities sharing port 443", rules.Rules)
+	}
+	for _, line := range []string{"create fw-admins6 hash:net family inet6 -exist", "add fw-admins6-tmp 2001:db8::1 -exist", "swap fw-admins-tmp fw-admins"} {
+		if !strings.Contains(rules.IPSets, line+"\n") {
+			t.Errorf("IPSets =\n%s\nwant %q", rules.IPSets, line)
+		}
+	}
+
+	changed, _ := utils.GenerateRules(cfg, ipsetData("5.5.5.5", "7.7.7.7"))
+	if changed.Rules != rules.Rules || changed.IPSets == rules.IPSets {
+		t.Error("GenerateRules() changed the rules for a new member; want the ipsets only")
+	}
+}
+
+const ipsetSave = `create fw-admins hash:net family inet hashsize 1024 maxelem 65536 bucketsize 12 initval 0x1c3f2b5e
+add fw-admins 1.1.1.1
+add fw-admins 10.0.0.0/8
+create fw-ent6-1a2b3c4d hash:net family inet6 hashsize 1024 maxelem 65536 bucketsize 12 initval 0x5e2d1f3a
+add fw-ent6-1a2b3c4d 2001:db8::1
+create fw-admins-tmp hash:net family inet hashsize 1024 maxelem 65536 bucketsize 12 initval 0x2b1c3d4e
+create blocklist hash:ip family inet hashsize 1024 maxelem 65536 bucketsize 12 initval 0x3c2d1e4f
+add blocklist 9.9.9.9
+`
+
+func TestRollbackRestoresIPSets(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesSaveBinary = filepath.Join(dir, "iptables-save")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	cfg.IpsetBinary = filepath.Join(dir, "ipset")
+	restored := filepath.Join(dir, "restored")
+	os.WriteFile(filepath.Join(dir, "saved"), []byte(ipsetSave), 0644)
+	os.WriteFile(cfg.IptablesSaveBinary, []byte("#!/bin/sh\nprintf '*filter\\nCOMMIT\\n'\n"), 0755)
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte("#!/bin/sh\ncat >/dev/null\n"), 0755)
+	destroyed := filepath.Join(dir, "destroyed")
+	os.WriteFile(cfg.IpsetBinary, []byte(fakeIpset(dir, restored, destroyed)), 0755)
+
+	snapshot, err := utils.SaveRules(cfg)
+	if err != nil {
+		t.Fatalf("SaveRules() = %v", err)
+	}
+	for _, line := range []string{"create fw-admins hash:net family inet -exist", "add fw-admins-tmp 10.0.0.0/8 -exist", "add fw-ent6-1a2b3c4d-tmp 2001:db8::1 -exist", "swap fw-ent6-1a2b3c4d-tmp fw-ent6-1a2b3c4d"} {
+		if !strings.Contains(snapshot.IPSets, line+"\n") {
+			t.Errorf("IPSets =\n%s\nwant %q", snapshot.IPSets, line)
+		}
+	}
+	if strings.Contains(snapshot.IPSets, "blocklist") || strings.Count(snapshot.IPSets, "create fw-admins-tmp ") != 1 {
+		t.Errorf("IPSets =\n%s\nwant the fw- sets only, without the leftover temporary set", snapshot.IPSets)
+	}
+
+	if err := utils.RestoreRules(cfg, snapshot); err != nil {
+		t.Fatalf("RestoreRules() = %v", err)
+	}
+	if content, _ := os.ReadFile(restored); string(content) != snapshot.IPSets {
+		t.Errorf("ipset restore got\n%s\nwant the snapshot\n%s", content, snapshot.IPSets)
+	}
+	if content, _ := os.ReadFile(destroyed); string(content) != "fw-auth-deadbeef\n" {
+		t.Errorf("destroyed sets = %q; want the fw-auth-deadbeef set created after the snapshot", content)
+	}
+}
+
+// fakeIpset returns an ipset script listing the sets of ipsetSave and a fw-auth-deadbeef set,
+// saving what it restores to restored and the names it destroys to destroyed
+func fakeIpset(dir, restored, destroyed string) string {
+	return "#!/bin/sh\ncase \"$1\" in\n" +
+		"save) cat " + filepath.Join(dir, "saved") + " ;;\n" +
+		"list) printf 'fw-admins\\nfw-ent6-1a2b3c4d\\nfw-auth-deadbeef\\nblocklist\\n' ;;\n" +
+		"restore) cat >" + restored + " ;;\n" +
+		"destroy) echo \"$2\" >>" + destroyed + " ;;\n" +
+		"esac\n"
+}
+
+func TestApplyRulesDestroysStaleIPSets(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesRulesFile = filepath.Join(dir, "GENERATED_IPTABLES_RULES.rules")
+	cfg.Ip6tablesRulesFile = filepath.Join(dir, "GENERATED_IP6TABLES_RULES.rules")
+	cfg.IpsetRulesFile = filepath.Join(dir, "GENERATED_IPSETS.ipset")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	cfg.IpsetBinary = filepath.Join(dir, "ipset")
+	destroyed := filepath.Join(dir, "destroyed")
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte("#!/bin/sh\ncat >/dev/null\n"), 0755)
+	os.WriteFile(cfg.IpsetBinary, []byte(fakeIpset(dir, filepath.Join(dir, "restored"), destroyed)), 0755)
+
+	rules, err := utils.GenerateRules(cfg, structs.Data{Admins: []structs.Admin{{Source: "1.1.1.1"}}})
+	if err != nil {
+		t.Fatalf("GenerateRules() = %v", err)
+	}
+	if err := utils.WriteRules(cfg, rules); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := utils.ApplyRules(cfg); err != nil {
+		t.Fatalf("ApplyRules() = %v", err)
+	}
+	if content, _ := os.ReadFile(destroyed); string(content) != "fw-ent6-1a2b3c4d\nfw-auth-deadbeef\n" {
+		t.Errorf("destroyed sets = %q; want the fw- sets the new rules don't use", content)
+	}
+}
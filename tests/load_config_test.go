@@ -0,0 +1,34 @@
+package tests
+
+import (
+	"firewall_script_docker/config"
+	"flag"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	t.Setenv("FIREWALL_CONFIG", "./testfiles/config.yaml")
+	t.Setenv("FIREWALL_NFT_BINARY", "/env/nft")
+	t.Setenv("FIREWALL_BACKEND", "iptables")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := config.NewLoader(flags)
+	if err := flags.Parse([]string{"-backend", "nftables"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.IptablesBinary != "/file/iptables" {
+		t.Errorf("IptablesBinary = %s; want /file/iptables from the config file", cfg.IptablesBinary)
+	}
+	if cfg.NftBinary != "/env/nft" {
+		t.Errorf("NftBinary = %s; want /env/nft from the environment", cfg.NftBinary)
+	}
+	if cfg.Backend != "nftables" {
+		t.Errorf("Backend = %s; want nftables from the flags", cfg.Backend)
+	}
+	if cfg.AdminFilePath != "firewall_files/admin_access_domains.txt" {
+		t.Errorf("AdminFilePath = %s; want it placed in relative_path", cfg.AdminFilePath)
+	}
+}
@@ -0,0 +1,198 @@
+package tests
+
+import (
+	"bufio"
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+)
+
+// the netns tests run the test binary again inside a namespace through ip netns exec, the
+// helper to run is passed in this variable
+const netnsHelperEnv = "FW_NETNS_HELPER"
+
+// TestNetnsHelper listens on or dials tcp ports inside a namespace for TestNetnsReachability,
+// it does nothing when run by go test
+func TestNetnsHelper(t *testing.T) {
+	switch os.Getenv(netnsHelperEnv) {
+	case "listen":
+		for _, port := range strings.Split(os.Getenv("FW_NETNS_PORTS"), ",") {
+			listener, err := net.Listen("tcp", ":"+port)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+		}
+		fmt.Println("ready")
+		select {}
+	case "dial":
+		dialer := net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: net.ParseIP(os.Getenv("FW_NETNS_SOURCE"))},
+			Timeout:   time.Second,
+		}
+		conn, err := dialer.Dial("tcp", os.Getenv("FW_NETNS_TARGET"))
+		if err != nil {
+			os.Exit(1)
+		}
+		conn.Close()
+		os.Exit(0)
+	}
+}
+
+// netnsHelper returns the command running TestNetnsHelper inside the namespace ns
+func netnsHelper(ns string, env ...string) *exec.Cmd {
+	cmd := exec.Command("ip", "netns", "exec", ns, os.Args[0], "-test.run=^TestNetnsHelper$")
+	cmd.Env = append(os.Environ(), env...)
+	return cmd
+}
+
+// listenIn starts listening on ports inside ns until the test ends
+func listenIn(t *testing.T, ns string, ports ...string) {
+	t.Helper()
+	cmd := netnsHelper(ns, netnsHelperEnv+"=listen", "FW_NETNS_PORTS="+strings.Join(ports, ","))
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	if line, _ := bufio.NewReader(stdout).ReadString('\n'); line != "ready\n" {
+		t.Fatalf("listening in %s on %v: %s", ns, ports, line)
+	}
+}
+
+// runSetup runs a command of the topology setup and fails the test when it fails
+func runSetup(t *testing.T, name string, args ...string) {
+	t.Helper()
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%s %s: %v\n%s", name, strings.Join(args, " "), err, output)
+	}
+}
+
+// TestNetnsReachability applies the generated ruleset inside a throwaway network namespace and
+// checks which sources can open tcp connections to the host ports and to a container behind a
+// bridge. The client namespace holds the admin, entity, authorized and anonymous addresses:
+//
+//	client 10.99.0.10-40 -- 10.99.0.1 host 172.30.0.1 (br-fwtest) -- 172.30.0.2 container
+func TestNetnsReachability(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the netns test in short mode")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("the netns test has to run as root")
+	}
+	restore, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		t.Skip("the netns test needs iptables-restore")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("the netns test needs the ip command")
+	}
+
+	prefix := fmt.Sprintf("fwt%d-", os.Getpid())
+	host, client, container := prefix+"host", prefix+"client", prefix+"ctr"
+	for _, ns := range []string{host, client, container} {
+		runSetup(t, "ip", "netns", "add", ns)
+		t.Cleanup(func() { exec.Command("ip", "netns", "del", ns).Run() })
+		runSetup(t, "ip", "-n", ns, "link", "set", "lo", "up")
+	}
+
+	runSetup(t, "ip", "-n", host, "link", "add", "fw-out", "type", "veth", "peer", "name", "fw-in", "netns", client)
+	runSetup(t, "ip", "-n", host, "addr", "add", "10.99.0.1/24", "dev", "fw-out")
+	runSetup(t, "ip", "-n", host, "link", "set", "fw-out", "up")
+	for _, source := range []string{"10.99.0.10", "10.99.0.20", "10.99.0.30", "10.99.0.40"} {
+		runSetup(t, "ip", "-n", client, "addr", "add", source+"/24", "dev", "fw-in")
+	}
+	runSetup(t, "ip", "-n", client, "link", "set", "fw-in", "up")
+
+	runSetup(t, "ip", "-n", host, "link", "add", "br-fwtest", "type", "bridge")
+	runSetup(t, "ip", "-n", host, "addr", "add", "172.30.0.1/24", "dev", "br-fwtest")
+	runSetup(t, "ip", "-n", host, "link", "set", "br-fwtest", "up")
+	runSetup(t, "ip", "-n", host, "link", "add", "fw-ctr", "type", "veth", "peer", "name", "eth0", "netns", container)
+	runSetup(t, "ip", "-n", host, "link", "set", "fw-ctr", "master", "br-fwtest", "up")
+	runSetup(t, "ip", "-n", container, "addr", "add", "172.30.0.2/24", "dev", "eth0")
+	runSetup(t, "ip", "-n", container, "link", "set", "eth0", "up")
+	runSetup(t, "ip", "-n", container, "route", "add", "default", "via", "172.30.0.1")
+	runSetup(t, "ip", "netns", "exec", host, "sh", "-c", "echo 1 > /proc/sys/net/ipv4/ip_forward")
+
+	listenIn(t, host, "22", "80", "443", "8443")
+	listenIn(t, container, "80")
+
+	data := structs.Data{
+		Admins:          []structs.Admin{{Source: "10.99.0.10"}},
+		EntityDomains:   []structs.AccessDomain{{Name: "partner.example.com", IPs: []string{"10.99.0.20"}, PortsArr: []structs.Port{{Number: 443, Proto: "tcp"}, {Number: 8080, Proto: "tcp"}}}},
+		MappedData:      map[string][]structs.Port{"10.99.0.30": {{Number: 8443, Proto: "tcp"}, {Number: 8080, Proto: "tcp"}}},
+		DockerInstalled: true,
+		ContainerInfos: []structs.ContainerInfo{{
+			ContainerID: "fwtest",
+			Ports:       []types.Port{{IP: "0.0.0.0", PrivatePort: 80, PublicPort: 8080, Type: "tcp"}},
+			Endpoints:   []structs.Endpoint{{NetworkID: "fwtest", NetworkName: "fwtest", Bridge: "br-fwtest", IPAddress: "172.30.0.2", Subnet: "172.30.0.0/24"}},
+		}},
+		PublicPortMetaData: structs.PublicPortMetaData{PublicPorts: "80", HasPublicPorts: true, Ports: utils.ParsePorts("80")},
+	}
+	data.MappedData2 = utils.FilterPortsArray(data.MappedData, utils.UniquePublicPorts(data.ContainerInfos))
+	data.UniqueNetworkIDs = utils.GetUniqueNetworkIDs(data.ContainerInfos)
+
+	// apply through ApplyRules with an iptables-restore running inside the host namespace
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesRulesFile = filepath.Join(dir, "GENERATED_IPTABLES_RULES.rules")
+	cfg.Ip6tablesRulesFile = filepath.Join(dir, "GENERATED_IP6TABLES_RULES.rules")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte(fmt.Sprintf("#!/bin/sh\nexec ip netns exec %s %s \"$@\"\n", host, restore)), 0755)
+	rules, err := utils.GenerateRules(cfg, data)
+	if err != nil {
+		t.Fatalf("GenerateRules() = %v", err)
+	}
+	if err := utils.WriteRules(cfg, rules); err != nil {
+		t.Fatal(err)
+	}
+	if output, err := utils.ApplyRules(cfg); err != nil {
+		t.Fatalf("ApplyRules() = %v\n%s", err, output)
+	}
+
+	targets := []string{"10.99.0.1:22", "10.99.0.1:80", "10.99.0.1:443", "10.99.0.1:8443", "10.99.0.1:8080"}
+	tests := []struct {
+		name    string
+		source  string
+		allowed []bool // by target, 8080 is the container port
+	}{
+		{"admin", "10.99.0.10", []bool{true, true, true, true, true}},
+		{"entity", "10.99.0.20", []bool{false, true, true, false, true}},
+		{"authorized", "10.99.0.30", []bool{false, true, false, true, true}},
+		{"anonymous", "10.99.0.40", []bool{false, true, false, false, false}},
+	}
+	for _, tt := range tests {
+		for i, target := range targets {
+			err := netnsHelper(client, netnsHelperEnv+"=dial", "FW_NETNS_SOURCE="+tt.source, "FW_NETNS_TARGET="+target).Run()
+			if connected := err == nil; connected != tt.allowed[i] {
+				t.Errorf("%s %s -> %s connected = %v; want %v", tt.name, tt.source, target, connected, tt.allowed[i])
+			}
+		}
+	}
+}
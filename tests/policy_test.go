@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"firewall_script_docker/config"
+	"firewall_script_docker/policy"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportPolicy(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.AdminFilePath = filepath.Join(dir, "admin_access_domains.txt")
+	cfg.EntityFilePath = filepath.Join(dir, "entity_access_domains.txt")
+	cfg.IpsPath = filepath.Join(dir, "authorized_access_ips.txt")
+	cfg.PublicPortPath = filepath.Join(dir, "public_ports.txt")
+	os.WriteFile(cfg.AdminFilePath, []byte("1.2.3.4\n"), 0644)
+	os.WriteFile(cfg.EntityFilePath, []byte("5.5.5.5:80,443\n6.6.6.6:80,443\n10.0.0.0/8:53/udp\n"), 0644)
+	os.WriteFile(cfg.PublicPortPath, []byte("8080"), 0644)
+
+	imported, err := policy.Import(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	admins, entities, publicPorts := imported.Resolve()
+	if len(admins) != 1 || admins[0].Source != "1.2.3.4" || len(entities) != 3 || len(publicPorts) != 1 {
+		t.Errorf("Resolve() = %v, %v, %v; want the admin, 3 entities and 1 public port", admins, entities, publicPorts)
+	}
+	if entities[1].Ports != "80,443" || entities[2].Ports != "53/udp" {
+		t.Errorf("Resolve() entities = %v; want the ports of the entity file", entities)
+	}
+
+	content, err := imported.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(dir, "policy.yaml")
+	os.WriteFile(filePath, content, 0644)
+	if _, err := policy.Load(filePath); err != nil {
+		t.Errorf("Load() of the imported policy = %v", err)
+	}
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tests := map[string]string{
+		"version: 2\n":                                                "unsupported policy version",
+		"version: 1\nrules:\n  - from: nobody\n":                      "unknown group",
+		"version: 1\nrules:\n  - from: any\n":                         "must list services, ports or containers",
+		"version: 1\nrules:\n  - from: any\n    services: [web]\n":    "unknown service",
+		"version: 1\nrules:\n  - from: any\n    ports: [80/icmp]\n":   "invalid port",
+		"version: 1\nrules:\n  - from: any\n    containers: [=web]\n": "invalid container",
+	}
+	for content, want := range tests {
+		filePath := filepath.Join(t.TempDir(), "policy.yaml")
+		os.WriteFile(filePath, []byte(content), 0644)
+		if _, err := policy.Load(filePath); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Load(%q) = %v; want an error containing %q", content, err, want)
+		}
+	}
+}
+
+func TestPolicyContainerRules(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(filePath, []byte(`version: 1
+groups:
+  admins: [1.2.3.4]
+  office: [10.20.0.0/16]
+services:
+  web: [443]
+rules:
+  - from: admins
+  - from: office
+    services: [web]
+    containers: [app, com.docker.compose.project=shop]
+  - from: any
+    containers: [status]
+`), 0644)
+	p, err := policy.Load(filePath)
+	if err != nil {
+		t.Fatalf("Load() = %v", err)
+	}
+	admins, domains, publicPorts := p.Resolve()
+	if len(admins) != 1 || len(domains) != 0 || len(publicPorts) != 0 {
+		t.Errorf("Resolve() = %v, %v, %v; want the admin only, container rules don't open host ports", admins, domains, publicPorts)
+	}
+	rules := p.ContainerRules()
+	if len(rules) != 2 {
+		t.Fatalf("ContainerRules() = %+v; want 2 rules", rules)
+	}
+	office := rules[0]
+	if len(office.Containers) != 2 || len(office.Access.Allow) != 1 || office.Access.Allow[0] != "office" || len(office.Access.Ports) != 1 || office.Access.Public {
+		t.Errorf("ContainerRules()[0] = %+v; want office to port 443 of app and the shop containers", office)
+	}
+	if status := rules[1]; !status.Access.Public || len(status.Access.Allow) != 0 || len(status.Access.Ports) != 0 {
+		t.Errorf("ContainerRules()[1] = %+v; want every port of status public", status)
+	}
+}
@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"errors"
+	"firewall_script_docker/utils"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestResolverRefresh(t *testing.T) {
+	answers := []string{"1.1.1.1"}
+	var lookupErr error
+	lookups := 0
+	resolver := utils.NewResolver(func(host string) ([]string, time.Duration, error) {
+		lookups++
+		return answers, 0, lookupErr
+	})
+	resolver.MinTTL = 0
+
+	if ips, err := resolver.Lookup("home.example.com"); err != nil || !slices.Equal(ips, []string{"1.1.1.1"}) {
+		t.Fatalf("Lookup() = %v, %v; want 1.1.1.1", ips, err)
+	}
+	if resolver.Refresh() {
+		t.Error("Refresh() = true; want false, the address did not change")
+	}
+
+	answers = []string{"2.2.2.2"}
+	if !resolver.Refresh() {
+		t.Error("Refresh() = false; want true, the address changed")
+	}
+
+	lookupErr = errors.New("no such host")
+	if resolver.Refresh() {
+		t.Error("Refresh() = true; want false, a failed lookup keeps the last answer")
+	}
+	if ips, err := resolver.Lookup("home.example.com"); err != nil || !slices.Equal(ips, []string{"2.2.2.2"}) {
+		t.Errorf("Lookup() = %v, %v; want the last good answer 2.2.2.2", ips, err)
+	}
+
+	resolver.MinTTL = time.Hour
+	lookupErr = nil
+	before := lookups
+	resolver.Refresh()
+	resolver.Lookup("home.example.com")
+	if lookups != before+1 {
+		t.Errorf("lookups = %d; want %d, the answer is cached until its ttl expires", lookups, before+1)
+	}
+}
+
+func TestResolverRefreshUnlocked(t *testing.T) {
+	var blocking atomic.Bool
+	release := make(chan struct{})
+	resolver := utils.NewResolver(func(host string) ([]string, time.Duration, error) {
+		if host == "slow.example.com" {
+			if blocking.Load() {
+				<-release
+			}
+			return []string{"1.1.1.1"}, 0, nil
+		}
+		return []string{"2.2.2.2"}, time.Hour, nil
+	})
+	resolver.MinTTL = 0
+	resolver.Lookup("slow.example.com")
+	resolver.Lookup("fast.example.com")
+
+	blocking.Store(true)
+	refreshed := make(chan bool)
+	go func() { refreshed <- resolver.Refresh() }()
+	looked := make(chan []string)
+	go func() {
+		ips, _ := resolver.Lookup("fast.example.com")
+		looked <- ips
+	}()
+	select {
+	case ips := <-looked:
+		if !slices.Equal(ips, []string{"2.2.2.2"}) {
+			t.Errorf("Lookup() = %v; want the cached 2.2.2.2", ips)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Lookup() blocked while Refresh() was resolving another host")
+	}
+	close(release)
+	if <-refreshed {
+		t.Error("Refresh() = true; want false, the address did not change")
+	}
+}
@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"firewall_script_docker/config"
+	"firewall_script_docker/utils"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRulesReportsFailingLine(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesRulesFile = filepath.Join(dir, "GENERATED_IPTABLES_RULES.rules")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	os.WriteFile(cfg.IptablesRulesFile, []byte("*filter\n:INPUT DROP [0:0]\n-A INPUT -p tcp --dportx 22 -j ACCEPT\nCOMMIT\n"), 0644)
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte("#!/bin/sh\ncat >/dev/null\necho 'iptables-restore: unknown option \"--dportx\"' >&2\necho 'Error occurred at line: 3' >&2\nexit 2\n"), 0755)
+
+	_, err := utils.ApplyRules(cfg)
+	var restoreErr *utils.RestoreError
+	if !errors.As(err, &restoreErr) {
+		t.Fatalf("ApplyRules() = %v; want a *RestoreError", err)
+	}
+	if restoreErr.Line != 3 || restoreErr.Rule != "-A INPUT -p tcp --dportx 22 -j ACCEPT" {
+		t.Errorf("RestoreError line = %d %q; want line 3 and its rule", restoreErr.Line, restoreErr.Rule)
+	}
+}
+
+func TestRollbackRestoresWhenInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.IptablesRulesFile = filepath.Join(dir, "GENERATED_IPTABLES_RULES.rules")
+	cfg.IptablesSaveBinary = filepath.Join(dir, "iptables-save")
+	cfg.IptablesRestoreBinary = filepath.Join(dir, "iptables-restore")
+	cfg.Ip6tablesRestoreBinary = ""
+	cfg.IpsetBinary = ""
+	cfg.ConfirmFile = filepath.Join(dir, "confirm")
+	restored := filepath.Join(dir, "restored")
+	os.WriteFile(cfg.IptablesRulesFile, []byte("*filter\n:INPUT DROP [0:0]\nCOMMIT\n"), 0644)
+	os.WriteFile(cfg.IptablesSaveBinary, []byte("#!/bin/sh\nprintf '*filter\\n:INPUT ACCEPT [0:0]\\nCOMMIT\\n'\n"), 0755)
+	os.WriteFile(cfg.IptablesRestoreBinary, []byte("#!/bin/sh\ncat >"+restored+"\n"), 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	_, err := utils.ApplyRulesWithRollback(cfg, utils.RollbackOptions{Timeout: time.Hour, Context: ctx})
+	if err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Fatalf("ApplyRulesWithRollback() = %v; want the wait interrupted", err)
+	}
+	if content, _ := os.ReadFile(restored); !strings.Contains(string(content), ":INPUT ACCEPT") {
+		t.Errorf("last restored ruleset =\n%s\nwant the snapshot taken before the apply", content)
+	}
+}
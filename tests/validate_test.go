@@ -0,0 +1,77 @@
+package tests
+
+import (
+	"firewall_script_docker/structs"
+	"firewall_script_docker/utils"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestValidateAccessFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "authorized_access_ips.txt")
+	os.WriteFile(filePath, []byte("5.5.5.5:80,44x3\n\n  6.6.6.6:5432,5432,53/udp\nbogus\n5.5.5.5:8080\n"), 0644)
+	published := []structs.Port{{Number: 80, Proto: "tcp"}, {Number: 5432, Proto: "tcp"}}
+
+	var got []string
+	for _, diagnostic := range utils.ValidateAccessFile(filePath, published, true) {
+		got = append(got, diagnostic.String()[len(filePath):])
+	}
+	want := []string{
+		`:1:12: bad port "44x3", expected a port or a range between 1 and 65535 with an optional /tcp, /udp or /sctp`,
+		`:3:16: duplicate port 5432`,
+		`:3:21: port 53/udp is not published by any container`,
+		`:4:1: expected host:port1,port2`,
+		`:5:1: duplicate entry, 5.5.5.5 is already listed on line 1`,
+		`:5:9: port 8080 is not published by any container`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ValidateAccessFile() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestValidatePublicPortsFile(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "public_ports.txt")
+	os.WriteFile(filePath, []byte("80, 443,\n8o,80"), 0644)
+	diagnostics := utils.ValidatePublicPortsFile(filePath)
+	if len(diagnostics) != 2 || diagnostics[0].Line != 2 || diagnostics[0].Column != 1 || diagnostics[1].Column != 4 {
+		t.Errorf("ValidatePublicPortsFile() = %v; want the bad port at 2:1 and the duplicate at 2:4", diagnostics)
+	}
+}
+
+func TestValidateMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if diagnostics := utils.ValidateAccessFile(filepath.Join(dir, "entity_access_domains.txt"), nil, false); len(diagnostics) != 0 {
+		t.Errorf("ValidateAccessFile() = %v; want a missing file skipped like apply does", diagnostics)
+	}
+	if diagnostics := utils.ValidatePublicPortsFile(filepath.Join(dir, "public_ports.txt")); len(diagnostics) != 0 {
+		t.Errorf("ValidatePublicPortsFile() = %v; want a missing file skipped like apply does", diagnostics)
+	}
+	if diagnostics := utils.ValidateAdminFile(filepath.Join(dir, "admin_access_domains.txt")); len(diagnostics) != 1 {
+		t.Errorf("ValidateAdminFile() = %v; want the missing admins file reported", diagnostics)
+	}
+}
+
+func TestContainerLabelsWithoutValidPort(t *testing.T) {
+	containers := []structs.ContainerInfo{{
+		Name:   "app",
+		Labels: map[string]string{utils.LabelPublic: "true", utils.LabelPorts: "443/tpc"},
+	}}
+	utils.ResolveContainerAccess(containers, nil, nil)
+	if len(containers[0].Access) != 0 {
+		t.Errorf("ResolveContainerAccess() = %+v; want no access when firewall.ports has no valid port", containers[0].Access)
+	}
+
+	var got []string
+	for _, diagnostic := range utils.ValidateContainerLabels(containers) {
+		got = append(got, diagnostic.String())
+	}
+	want := []string{
+		`container app: firewall.ports label: bad port "443/tpc", expected a port or a range between 1 and 65535 with an optional /tcp, /udp or /sctp`,
+		`container app: firewall.ports label has no valid port, the other firewall labels of the container are ignored`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ValidateContainerLabels() =\n%v\nwant\n%v", got, want)
+	}
+}
@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"bytes"
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// iptables modes, tables rewrites the whole filter and nat tables, chains only manages our own
+// chains and leaves the rules of fail2ban, WireGuard, libvirt or Tailscale in place, docker-user
+// manages INPUT, OUTPUT and DOCKER-USER and leaves the chains of dockerd in place
+const (
+	ModeTables     = "tables"
+	ModeChains     = "chains"
+	ModeDockerUser = "docker-user"
+)
+
+// NoFlush reports whether the iptables mode applies its rulesets with --noflush, only the
+// chains declared or flushed by the ruleset are then replaced
+func NoFlush(cfg *config.Config) bool {
+	return cfg.IptablesMode == ModeChains || cfg.IptablesMode == ModeDockerUser
+}
+
+// iptablesChainsTmpl renders our chains for iptables-restore --noflush, declaring a chain flushes
+// it so the ruleset can be applied again. The jumps to them are only kept by ApplyRules when
+// they are not live yet.
+const iptablesChainsTmpl = `# Generated on {{ .CurrentDate }}{{ if .IPv6 }} for ip6tables{{ end }}, apply with --noflush
+*filter
+:FIREWALL-INPUT - [0:0]
+{{- if .DockerForward }}
+:FIREWALL-FORWARD - [0:0]
+{{- end }}
+-A INPUT -j FIREWALL-INPUT
+{{- if .DockerForward }}
+-I DOCKER-USER -j FIREWALL-FORWARD
+{{- end }}
+
+-A FIREWALL-INPUT -m conntrack --ctstate ESTABLISHED -j ACCEPT
+#LOCALHOST
+-A FIREWALL-INPUT -i lo -j ACCEPT
+{{- if .IPv6 }}
+#ICMPV6 neighbor discovery and path mtu discovery
+-A FIREWALL-INPUT -p ipv6-icmp -j ACCEPT
+{{- end }}
+
+{{- if $.Admins }}
+#ADMIN RULES
+{{- range $admin := .Admins }}
+-A FIREWALL-INPUT {{ $.SourceMatch $admin.Source }}{{ $admin.Comment }} -p tcp -m state --state NEW -m tcp -j ACCEPT
+{{- end }}
+{{- end }}
+
+{{- if .PublicPortMetaData.HasPublicPorts }}
+#PUBLIC PORTS
+{{- range $proto, $ports := .PublicPortMetaData.PortsByProto }}
+-A FIREWALL-INPUT -m state --state NEW -p {{ $proto }} -m {{ $proto }} -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
+{{- end }}
+
+{{- if $.EntityDomains }}
+#ENTITY RULES
+{{- range $domain := .EntityDomains }}
+{{- range $ip := $domain.IPs }}
+{{- range $proto, $ports := $domain.PortsByProto }}
+-A FIREWALL-INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $proto }} -m state --state NEW -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+#allow specific hosts to ports
+{{- range $ip, $ports := $.MappedData2}}
+{{- range $port := $ports}}
+-A FIREWALL-INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $port.Proto }} -m state --state NEW -m {{ $port.Proto }} --dport {{ $port.Range ":" }} -j ACCEPT
+{{- end}}
+{{- end}}
+{{- /* the chain ends the way the INPUT policy of the tables mode would */}}
+{{- if or $.Admins $.IPv6 }}
+-A FIREWALL-INPUT -j DROP
+{{- end }}
+
+{{- if .DockerForward }}
+
+# DOCKER-USER sees the packets after the DNAT, RETURN hands them back to the docker chains
+-A FIREWALL-FORWARD -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+{{- if .IPv6 }}
+-A FIREWALL-FORWARD -p ipv6-icmp -j RETURN
+{{- end }}
+-A FIREWALL-FORWARD -i docker0 -j RETURN
+{{- range $id := .UniqueNetworkIDs}}
+-A FIREWALL-FORWARD -i {{ $id.Bridge }} -j RETURN
+{{- end }}
+{{- range .ForwardSections }}
+
+#{{ .Comment }}
+{{- range .Rules }}
+-A FIREWALL-FORWARD {{ if .Source }}{{ $.SourceMatch .Source }}{{ .Comment }} {{ end }}-d {{ .Endpoint.IPAddress }}/{{ $.HostPrefixLen }} -o {{ .Endpoint.Bridge }} -p {{ .Port.Type }} -m {{ .Port.Type }} --dport {{ .Port.PrivatePort }} -j RETURN
+{{- end }}
+{{- end }}
+
+-A FIREWALL-FORWARD -o docker0 -j DROP
+{{- range $id := .UniqueNetworkIDs}}
+-A FIREWALL-FORWARD -o {{ $id.Bridge }} -j DROP
+{{- end }}
+{{- end }}
+COMMIT
+
+{{- if .DockerInstalled }}
+
+# NAT for docker to access docker container
+*nat
+:FIREWALL-DNAT - [0:0]
+-A PREROUTING -m addrtype --dst-type LOCAL -j FIREWALL-DNAT
+
+{{- range $container := .ContainerInfos}}
+{{- range $endpoint := .Endpoints}}
+{{- range $container.Ports}}
+-A FIREWALL-DNAT ! -i {{ $endpoint.Bridge }} -p {{ .Type }} -m {{ .Type }} --dport {{ .PublicPort }} -j DNAT --to-destination {{ $.DNATAddress $endpoint.IPAddress }}:{{ .PrivatePort }}
+{{- end}}
+{{- end}}
+{{- end}}
+COMMIT
+{{- end }}
+`
+
+// GenerateIPTablesChains renders the ruleset of the chains mode
+func GenerateIPTablesChains(data structs.Data) (string, error) {
+	tmpl, err := template.New("iptables-chains").Parse(iptablesChainsTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// HasIPv6DockerUser reports whether ip6tables-save lists the DOCKER-USER chain of dockerd
+func HasIPv6DockerUser(cfg *config.Config) bool {
+	if cfg.Ip6tablesSaveBinary == "" {
+		return false
+	}
+	live, err := exec.Command(cfg.Ip6tablesSaveBinary, "-t", "filter").Output()
+	if err != nil {
+		return false
+	}
+	return chainDeclared(string(live), "DOCKER-USER")
+}
+
+// chainDeclared reports whether an iptables-save output declares chain
+func chainDeclared(live, chain string) bool {
+	for _, line := range strings.Split(live, "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 && fields[0] == ":"+chain {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedChains returns the chains a ruleset declares or flushes by table, with --noflush the
+// other chains keep their rules and only get the ones of the ruleset added
+func ownedChains(rules string) map[string]map[string]bool {
+	owned := make(map[string]map[string]bool)
+	var table string
+	for _, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			owned[table] = make(map[string]bool)
+		case strings.HasPrefix(line, ":") && len(fields) > 0 && table != "":
+			owned[table][fields[0][1:]] = true
+		case len(fields) == 2 && fields[0] == "-F" && table != "":
+			owned[table][fields[1]] = true
+		}
+	}
+	return owned
+}
+
+// withoutLiveJumps drops the rules of a --noflush ruleset that go into chains it doesn't own and
+// are already in the live iptables-save output, they would be added again on every apply
+func withoutLiveJumps(rules, live []byte) []byte {
+	liveRules := make(map[string]bool)
+	var table string
+	for _, line := range strings.Split(string(live), "\n") {
+		line = ruleCounters.ReplaceAllString(strings.TrimSpace(line), "")
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+		} else if strings.HasPrefix(line, "-A ") {
+			liveRules[table+" "+line] = true
+		}
+	}
+
+	owned := ownedChains(string(rules))
+	var kept []string
+	table = ""
+	for _, line := range strings.Split(string(rules), "\n") {
+		fields := strings.Fields(line)
+		if strings.HasPrefix(line, "*") {
+			table = line[1:]
+		} else if len(fields) >= 2 && (fields[0] == "-A" || fields[0] == "-I") && !owned[table][fields[1]] {
+			fields[0] = "-A"
+			if liveRules[table+" "+strings.Join(fields, " ")] {
+				continue
+			}
+		}
+		kept = append(kept, line)
+	}
+	return []byte(strings.Join(kept, "\n"))
+}
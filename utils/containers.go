@@ -0,0 +1,50 @@
+package utils
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+)
+
+// ContainerSource lists the containers and inspects the networks the ruleset is rendered from,
+// the docker *client.Client is the real one
+type ContainerSource interface {
+	ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error)
+	NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error)
+}
+
+// FixtureSource is an in memory ContainerSource holding a recorded docker topology
+type FixtureSource struct {
+	Containers []types.Container       `json:"containers"` // as returned by GET /containers/json?all=1
+	Networks   []types.NetworkResource `json:"networks"`   // as returned by GET /networks
+}
+
+// LoadFixtureSource reads a FixtureSource from a json file
+func LoadFixtureSource(path string) (*FixtureSource, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var source FixtureSource
+	if err := json.Unmarshal(content, &source); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return &source, nil
+}
+
+func (s *FixtureSource) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	return s.Containers, nil
+}
+
+func (s *FixtureSource) NetworkInspect(ctx context.Context, networkID string, options types.NetworkInspectOptions) (types.NetworkResource, error) {
+	for _, network := range s.Networks {
+		if network.ID == networkID {
+			return network, nil
+		}
+	}
+	return types.NetworkResource{}, fmt.Errorf("network %s not found", networkID)
+}
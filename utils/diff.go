@@ -0,0 +1,212 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ChainDiff holds the rules of a chain that are only live or only generated
+type ChainDiff struct {
+	Table      string
+	Chain      string
+	LivePolicy string // ACCEPT, DROP or - for user chains, empty when the chain is not live
+	Policy     string // the generated policy, empty when the chain is not generated
+	Added      []string
+	Removed    []string
+}
+
+func (d ChainDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s %s", d.Table, d.Chain)
+	switch {
+	case d.LivePolicy == "":
+		b.WriteString(" (new chain)")
+	case d.Policy == "":
+		b.WriteString(" (deleted chain)")
+	case d.LivePolicy != d.Policy:
+		fmt.Fprintf(&b, " (policy %s -> %s)", d.LivePolicy, d.Policy)
+	}
+	b.WriteString("\n")
+	for _, rule := range d.Removed {
+		b.WriteString("- " + rule + "\n")
+	}
+	for _, rule := range d.Added {
+		b.WriteString("+ " + rule + "\n")
+	}
+	return b.String()
+}
+
+// chain is a chain of a parsed ruleset, rules maps the normalised key of each rule to its text
+type chain struct {
+	policy string
+	rules  map[string]string
+	keys   []string // in the order of the ruleset, a key is repeated for duplicate rules
+}
+
+var (
+	// iptables-save -c prefixes every rule with its counters
+	ruleCounters = regexp.MustCompile(`^\[\d+:\d+\]\s+`)
+	// comments are ignored as they don't change what a rule matches
+	ruleComment = regexp.MustCompile(`\s+-m comment --comment ("[^"]*"|\S+)`)
+)
+
+// normalizeRule splits a rule with comma separated -s or -d addresses into one rule per address,
+// the way iptables-save lists them, and gives single addresses their /32 or /128 prefix
+func normalizeRule(rule string) []string {
+	rule = ruleComment.ReplaceAllString(rule, "")
+	tokens := strings.Fields(rule)
+	rules := [][]string{tokens}
+	for i := 0; i+1 < len(tokens); i++ {
+		if tokens[i] != "-s" && tokens[i] != "-d" {
+			continue
+		}
+		var expanded [][]string
+		for _, address := range strings.Split(tokens[i+1], ",") {
+			if !strings.Contains(address, "/") {
+				if isIPv6(address) {
+					address += "/128"
+				} else {
+					address += "/32"
+				}
+			}
+			for _, r := range rules {
+				r = slices.Clone(r)
+				r[i+1] = address
+				expanded = append(expanded, r)
+			}
+		}
+		rules = expanded
+	}
+	var normalized []string
+	for _, r := range rules {
+		normalized = append(normalized, strings.Join(r, " "))
+	}
+	return normalized
+}
+
+// ruleKey returns a key equal for rules that only differ by the order of their options, each
+// option with its values and a leading ! is kept together
+func ruleKey(rule string) string {
+	var options []string
+	for _, token := range strings.Fields(rule) {
+		last := len(options) - 1
+		if last >= 0 && (!strings.HasPrefix(token, "-") && token != "!" || options[last] == "!") {
+			options[last] += " " + token
+		} else {
+			options = append(options, token)
+		}
+	}
+	sort.Strings(options)
+	return strings.Join(options, " ")
+}
+
+// parseRuleset parses an iptables-save or iptables-restore ruleset into its chains by table
+func parseRuleset(rules string) map[string]map[string]*chain {
+	tables := make(map[string]map[string]*chain)
+	var table string
+	for _, line := range strings.Split(rules, "\n") {
+		line = ruleCounters.ReplaceAllString(strings.TrimSpace(line), "")
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || line == "COMMIT":
+		case strings.HasPrefix(line, "*"):
+			table = line[1:]
+			tables[table] = make(map[string]*chain)
+		case strings.HasPrefix(line, ":") && table != "":
+			fields := strings.Fields(line[1:])
+			if len(fields) >= 2 {
+				tables[table][fields[0]] = &chain{policy: fields[1], rules: make(map[string]string)}
+			}
+		case (strings.HasPrefix(line, "-A ") || strings.HasPrefix(line, "-I ")) && table != "":
+			// iptables-save lists inserted rules as appended ones
+			line = "-A " + line[3:]
+			for _, rule := range normalizeRule(line) {
+				name := strings.Fields(rule)[1]
+				c, found := tables[table][name]
+				if !found {
+					c = &chain{policy: "-", rules: make(map[string]string)}
+					tables[table][name] = c
+				}
+				key := ruleKey(rule)
+				c.rules[key] = rule
+				c.keys = append(c.keys, key)
+			}
+		}
+	}
+	return tables
+}
+
+// DiffRulesets compares a live ruleset from iptables-save with a generated one, ignoring
+// counters, comments and the order of the rules within a chain. Tables that are not
+// generated are left out, iptables-restore leaves them untouched. With noflush only the
+// generated chains are compared and the ones it doesn't declare or flush only report the
+// rules they are missing.
+func DiffRulesets(live, generated string, noflush bool) []ChainDiff {
+	liveTables, generatedTables := parseRuleset(live), parseRuleset(generated)
+	owned := ownedChains(generated)
+	var diffs []ChainDiff
+	for table, generatedChains := range generatedTables {
+		liveChains := liveTables[table]
+		names := make(map[string]bool)
+		if !noflush {
+			for name := range liveChains {
+				names[name] = true
+			}
+		}
+		for name := range generatedChains {
+			names[name] = true
+		}
+		for name := range names {
+			liveChain, generatedChain := liveChains[name], generatedChains[name]
+			diff := ChainDiff{Table: table, Chain: name}
+			if liveChain != nil {
+				diff.LivePolicy = liveChain.policy
+			}
+			if generatedChain != nil {
+				diff.Policy = generatedChain.policy
+			}
+			diff.Added = missingRules(generatedChain, liveChain)
+			if noflush && !owned[table][name] {
+				if liveChain != nil {
+					diff.Policy = diff.LivePolicy
+				}
+			} else {
+				diff.Removed = missingRules(liveChain, generatedChain)
+			}
+			if diff.LivePolicy != diff.Policy || len(diff.Added) > 0 || len(diff.Removed) > 0 {
+				diffs = append(diffs, diff)
+			}
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Table != diffs[j].Table {
+			return diffs[i].Table < diffs[j].Table
+		}
+		return diffs[i].Chain < diffs[j].Chain
+	})
+	return diffs
+}
+
+// missingRules returns the rules of from that are not in to, duplicates are counted
+func missingRules(from, to *chain) []string {
+	if from == nil {
+		return nil
+	}
+	remaining := make(map[string]int)
+	if to != nil {
+		for _, key := range to.keys {
+			remaining[key]++
+		}
+	}
+	var missing []string
+	for _, key := range from.keys {
+		if remaining[key] > 0 {
+			remaining[key]--
+			continue
+		}
+		missing = append(missing, from.rules[key])
+	}
+	return missing
+}
@@ -0,0 +1,239 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultHostTTL is how long the addresses of a host are kept when its ttl is unknown,
+// e.g. for hosts of /etc/hosts or completed by a search domain
+const DefaultHostTTL = 5 * time.Minute
+
+// resolvConf lists the nameservers queried for the ttl of the hosts
+const resolvConf = "/etc/resolv.conf"
+
+// recordTTLs enables the queries for the ttl of the hosts, see UseRecordTTLs
+var recordTTLs atomic.Bool
+
+// UseRecordTTLs makes the lookups ask the nameservers of resolv.conf for the ttl of the
+// addresses. Only the daemon re-resolves the hosts when they expire, the other commands keep
+// DefaultHostTTL and save the extra queries.
+func UseRecordTTLs() {
+	recordTTLs.Store(true)
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+)
+
+// nameservers returns the nameservers of resolv.conf with their port
+func nameservers() []string {
+	file, err := os.Open(resolvConf)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, net.JoinHostPort(fields[1], "53"))
+		}
+	}
+	return servers
+}
+
+// dnsQuery builds a recursive query for one record type of host
+func dnsQuery(id uint16, host string, qtype uint16) []byte {
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00)             // recursion desired
+	msg = append(msg, 0, 1, 0, 0, 0, 0, 0, 0) // one question
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, 1) // class IN
+}
+
+var (
+	errBadDNSMessage = errors.New("malformed dns response")
+	errTruncatedDNS  = errors.New("truncated dns response")
+)
+
+// skipName returns the offset following the possibly compressed name at offset
+func skipName(msg []byte, offset int) (int, error) {
+	for offset < len(msg) {
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			return offset + 1, nil
+		case length&0xC0 == 0xC0:
+			return offset + 2, nil
+		}
+		offset += length + 1
+	}
+	return 0, errBadDNSMessage
+}
+
+// ParseDNSAnswer returns the addresses of the response to the query id and the lowest ttl of its
+// answers, cname records included
+func ParseDNSAnswer(msg []byte, id uint16) ([]string, time.Duration, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg) != id {
+		return nil, 0, errBadDNSMessage
+	}
+	if msg[2]&0x02 != 0 {
+		return nil, 0, errTruncatedDNS
+	}
+	if rcode := msg[3] & 0x0F; rcode != 0 {
+		return nil, 0, fmt.Errorf("dns response code %d", rcode)
+	}
+	questions, answers := binary.BigEndian.Uint16(msg[4:]), binary.BigEndian.Uint16(msg[6:])
+	offset := 12
+	var err error
+	for i := 0; i < int(questions); i++ {
+		if offset, err = skipName(msg, offset); err != nil {
+			return nil, 0, err
+		}
+		offset += 4
+	}
+
+	var addresses []string
+	var ttl time.Duration
+	for i := 0; i < int(answers); i++ {
+		if offset, err = skipName(msg, offset); err != nil || offset+10 > len(msg) {
+			return nil, 0, errBadDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		recordTTL := time.Duration(binary.BigEndian.Uint32(msg[offset+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+length > len(msg) {
+			return nil, 0, errBadDNSMessage
+		}
+		// a cname expires with the addresses it points to
+		if i == 0 || recordTTL < ttl {
+			ttl = recordTTL
+		}
+		if rtype == dnsTypeA && length == net.IPv4len || rtype == dnsTypeAAAA && length == net.IPv6len {
+			addresses = append(addresses, net.IP(msg[offset:offset+length]).String())
+		}
+		offset += length
+	}
+	return addresses, ttl, nil
+}
+
+// exchange sends a query to server over udp or tcp and returns the response, tcp messages
+// are prefixed by their length
+func exchange(network, server string, query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, 3*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+
+	if network == "tcp" {
+		query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	if network == "udp" {
+		buf := make([]byte, 4096)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	var length [2]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// queryNameserver asks one nameserver for the records of host of one type, a truncated udp
+// answer is asked again over tcp
+func queryNameserver(server, host string, qtype uint16) ([]string, time.Duration, error) {
+	id := uint16(rand.Intn(1 << 16))
+	query := dnsQuery(id, host, qtype)
+	msg, err := exchange("udp", server, query)
+	if err != nil {
+		return nil, 0, err
+	}
+	addresses, ttl, err := ParseDNSAnswer(msg, id)
+	if !errors.Is(err, errTruncatedDNS) {
+		return addresses, ttl, err
+	}
+	if msg, err = exchange("tcp", server, query); err != nil {
+		return nil, 0, err
+	}
+	return ParseDNSAnswer(msg, id)
+}
+
+// lookupWithTTL resolves host with net.DefaultResolver, which follows /etc/hosts and the search
+// and options of resolv.conf, and asks the nameservers for the ttl of the addresses it found
+// once UseRecordTTLs was called
+func lookupWithTTL(host string) ([]string, time.Duration, error) {
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, 0, err
+	}
+	var addresses []string
+	for _, ip := range ips {
+		addresses = append(addresses, ip.String())
+	}
+	if !recordTTLs.Load() {
+		return addresses, DefaultHostTTL, nil
+	}
+	return addresses, recordTTL(host, addresses), nil
+}
+
+// recordTTL returns the lowest ttl of the A and AAAA records of host, DefaultHostTTL when the
+// nameservers of resolv.conf don't answer with the same addresses as the resolver
+func recordTTL(host string, addresses []string) time.Duration {
+	for _, server := range nameservers() {
+		var found []string
+		var ttl time.Duration
+		answered := true
+		for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+			records, recordsTTL, err := queryNameserver(server, host, qtype)
+			if err != nil {
+				answered = false
+				break
+			}
+			if len(records) > 0 && (len(found) == 0 || recordsTTL < ttl) {
+				ttl = recordsTTL
+			}
+			found = append(found, records...)
+		}
+		if !answered {
+			continue
+		}
+		if sameAddresses(found, addresses) {
+			return ttl
+		}
+		break
+	}
+	return DefaultHostTTL
+}
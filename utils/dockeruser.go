@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"bytes"
+	"firewall_script_docker/structs"
+	"text/template"
+)
+
+// iptablesDockerUserTmpl renders INPUT, OUTPUT and DOCKER-USER for iptables-restore --noflush,
+// dockerd keeps its own chains and nat rules. DOCKER-USER sees the packets after the DNAT,
+// so the published port is matched on the original destination kept by conntrack.
+const iptablesDockerUserTmpl = `# Generated on {{ .CurrentDate }}{{ if .IPv6 }} for ip6tables{{ end }}, apply with --noflush
+*filter
+{{- /* without admins the ipv6 ruleset still drops, admins may only reach the host over ipv4 */}}
+{{- if or $.Admins $.IPv6 }}
+:INPUT DROP [0:0]
+{{- else }}
+:INPUT ACCEPT [0:0]
+{{- end }}
+:OUTPUT DROP [0:0]
+{{- if .DockerForward }}
+:DOCKER-USER - [0:0]
+{{- end }}
+-F INPUT
+-F OUTPUT
+
+-A INPUT -m conntrack --ctstate ESTABLISHED -j ACCEPT
+#LOCALHOST
+-A INPUT -i lo -j ACCEPT
+{{- if .IPv6 }}
+#ICMPV6 neighbor discovery and path mtu discovery
+-A INPUT -p ipv6-icmp -j ACCEPT
+{{- end }}
+
+{{- if $.Admins }}
+#ADMIN RULES
+{{- range $admin := .Admins }}
+-A INPUT {{ $.SourceMatch $admin.Source }}{{ $admin.Comment }} -p tcp -m state --state NEW -m tcp -j ACCEPT
+{{- end }}
+{{- end }}
+
+{{- if .PublicPortMetaData.HasPublicPorts }}
+#PUBLIC PORTS
+{{- range $proto, $ports := .PublicPortMetaData.PortsByProto }}
+-A INPUT -m state --state NEW -p {{ $proto }} -m {{ $proto }} -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
+{{- end }}
+
+{{- if $.EntityDomains }}
+#ENTITY RULES
+{{- range $domain := .EntityDomains }}
+{{- range $ip := $domain.IPs }}
+{{- range $proto, $ports := $domain.PortsByProto }}
+-A INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $proto }} -m state --state NEW -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+
+#allow specific hosts to ports
+{{- range $ip, $ports := $.MappedData2}}
+{{- range $port := $ports}}
+-A INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $port.Proto }} -m state --state NEW -m {{ $port.Proto }} --dport {{ $port.Range ":" }} -j ACCEPT
+{{- end}}
+{{- end}}
+
+
+-A OUTPUT -m state --state NEW,RELATED,ESTABLISHED -j ACCEPT
+-A OUTPUT -o lo -j ACCEPT
+{{- if .IPv6 }}
+-A OUTPUT -p ipv6-icmp -j ACCEPT
+{{- end }}
+
+{{- if .DockerForward }}
+
+-A DOCKER-USER -m conntrack --ctstate RELATED,ESTABLISHED -j RETURN
+{{- if .IPv6 }}
+-A DOCKER-USER -p ipv6-icmp -j RETURN
+{{- end }}
+-A DOCKER-USER -i docker0 -j RETURN
+{{- range $id := .UniqueNetworkIDs}}
+-A DOCKER-USER -i {{ $id.Bridge }} -j RETURN
+{{- end }}
+{{- range .ForwardSections }}
+
+#{{ .Comment }}
+{{- range .Rules }}
+-A DOCKER-USER {{ if .Source }}{{ $.SourceMatch .Source }}{{ .Comment }} {{ end }}-d {{ .Endpoint.IPAddress }}/{{ $.HostPrefixLen }} -o {{ .Endpoint.Bridge }} -p {{ .Port.Type }} -m conntrack --ctorigdstport {{ .Port.PublicPort }} --ctdir ORIGINAL -j RETURN
+{{- end }}
+{{- end }}
+
+-A DOCKER-USER -o docker0 -j DROP
+{{- range $id := .UniqueNetworkIDs}}
+-A DOCKER-USER -o {{ $id.Bridge }} -j DROP
+{{- end }}
+-A DOCKER-USER -j RETURN
+{{- end }}
+COMMIT
+`
+
+// GenerateIPTablesDockerUser renders the ruleset of the docker-user mode
+func GenerateIPTablesDockerUser(data structs.Data) (string, error) {
+	tmpl, err := template.New("iptables-docker-user").Parse(iptablesDockerUserTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
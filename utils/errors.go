@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoAdmins is returned when neither the admin file nor the policy gives an admin ip, the
+// rules would lock everyone out of the server
+var ErrNoAdmins = errors.New("admins are not set put domains access in admin_access_domains or an admin rule in the policy")
+
+// DockerError is returned when the docker api can't be reached or fails
+type DockerError struct {
+	Op  string // what docker was asked, e.g. "listing containers"
+	Err error
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("docker: %s: %v", e.Op, e.Err)
+}
+
+func (e *DockerError) Unwrap() error {
+	return e.Err
+}
+
+// AccessError is returned when an access file or the policy can't be read
+type AccessError struct {
+	File string
+	Err  error
+}
+
+func (e *AccessError) Error() string {
+	return fmt.Sprintf("reading %s: %v", e.File, e.Err)
+}
+
+func (e *AccessError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+)
+
+// relevantEvents lists the docker events that can change the generated ruleset
+var relevantEvents = map[events.Type][]events.Action{
+	events.ContainerEventType: {events.ActionStart, events.ActionStop, events.ActionDie},
+	events.NetworkEventType:   {events.ActionConnect, events.ActionDisconnect, events.ActionCreate, events.ActionDestroy},
+}
+
+// wait before subscribing again when the docker events stream fails
+const eventsReconnectDelay = 5 * time.Second
+
+// WatchDockerEvents calls onChange once for every burst of relevant docker events,
+// when no other event arrived for the debounce duration. It blocks until ctx is cancelled.
+func WatchDockerEvents(ctx context.Context, cli *client.Client, debounce time.Duration, onChange func()) {
+	args := filters.NewArgs()
+	for eventType, actions := range relevantEvents {
+		args.Add("type", string(eventType))
+		for _, action := range actions {
+			args.Add("event", string(action))
+		}
+	}
+
+	var pending <-chan time.Time
+	for {
+		messages, errs := cli.Events(ctx, types.EventsOptions{Filters: args})
+	stream:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg := <-messages:
+				// the event filter also lets through e.g. container create, only keep the pairs we care about
+				if slices.Contains(relevantEvents[msg.Type], msg.Action) {
+					pending = time.After(debounce)
+				}
+			case <-pending:
+				pending = nil
+				onChange()
+			case err := <-errs:
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Println("Error reading docker events:", err)
+				break stream
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventsReconnectDelay):
+		}
+		// events may have been missed while the stream was down
+		pending = time.After(debounce)
+	}
+}
@@ -0,0 +1,107 @@
+package utils
+
+import (
+	"firewall_script_docker/structs"
+	"net"
+	"slices"
+)
+
+// defaultBridgeSubnet is docker's default ipv4 subnet of docker0, used when no container runs on it
+const defaultBridgeSubnet = "172.17.0.0/16"
+
+// isIPv6 reports whether ip is an ipv6 address or network
+func isIPv6(ip string) bool {
+	if _, network, err := net.ParseCIDR(ip); err == nil {
+		return network.IP.To4() == nil
+	}
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// FilterFamily returns the part of data that belongs to the ipv4 or the ipv6 family. For ipv6
+// the container endpoints carry their ipv6 address and subnet in IPAddress and Subnet, so the
+// same templates render both families.
+func FilterFamily(data structs.Data, ipv6 bool) structs.Data {
+	filtered := data
+	filtered.IPv6 = ipv6
+
+	filtered.Admins = nil
+	for _, admin := range data.Admins {
+		if isIPv6(admin.Source) == ipv6 {
+			filtered.Admins = append(filtered.Admins, admin)
+		}
+	}
+
+	filtered.EntityDomains = nil
+	for _, domain := range data.EntityDomains {
+		var ips []string
+		for _, ip := range domain.IPs {
+			if isIPv6(ip) == ipv6 {
+				ips = append(ips, ip)
+			}
+		}
+		if len(ips) > 0 {
+			domain.IPs = ips
+			filtered.EntityDomains = append(filtered.EntityDomains, domain)
+		}
+	}
+
+	filtered.MappedData = filterMappedData(data.MappedData, ipv6)
+	filtered.MappedData2 = filterMappedData(data.MappedData2, ipv6)
+
+	filtered.ContainerInfos = nil
+	filtered.DefaultBridgeSubnet = ""
+	for _, container := range data.ContainerInfos {
+		var endpoints []structs.Endpoint
+		for _, endpoint := range container.Endpoints {
+			if ipv6 {
+				endpoint.IPAddress, endpoint.Subnet = endpoint.IPv6Address, endpoint.IPv6Subnet
+			}
+			if endpoint.IPAddress == "" {
+				continue
+			}
+			if endpoint.Bridge == "docker0" {
+				filtered.DefaultBridgeSubnet = endpoint.Subnet
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		if len(endpoints) > 0 {
+			container.Endpoints = endpoints
+			container.Access = slices.Clone(container.Access)
+			for i := range container.Access {
+				container.Access[i].Sources = filterSources(container.Access[i].Sources, ipv6)
+			}
+			filtered.ContainerInfos = append(filtered.ContainerInfos, container)
+		}
+	}
+	if filtered.DefaultBridgeSubnet == "" && !ipv6 {
+		filtered.DefaultBridgeSubnet = defaultBridgeSubnet
+	}
+	filtered.UniqueNetworkIDs = GetUniqueNetworkIDs(filtered.ContainerInfos)
+	return filtered
+}
+
+// filterSources keeps the addresses and prefixes of the family
+func filterSources(sources []string, ipv6 bool) []string {
+	var filtered []string
+	for _, source := range sources {
+		if isIPv6(source) == ipv6 {
+			filtered = append(filtered, source)
+		}
+	}
+	return filtered
+}
+
+// filterMappedData keeps the ips of the family in a map of ips and ports
+func filterMappedData(mappedData map[string][]structs.Port, ipv6 bool) map[string][]structs.Port {
+	if mappedData == nil {
+		return nil
+	}
+	filtered := make(map[string][]structs.Port)
+	for ip, ports := range mappedData {
+		if isIPv6(ip) == ipv6 {
+			filtered[ip] = ports
+		}
+	}
+	return filtered
+}
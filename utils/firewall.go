@@ -4,14 +4,23 @@ import (
 	"bytes"
 	"firewall_script_docker/config"
 	"firewall_script_docker/structs"
-	"html/template"
+	"fmt"
+	"os"
 	"os/exec"
+	"text/template"
+)
+
+// supported firewall backends
+const (
+	BackendIPTables = "iptables"
+	BackendNftables = "nftables"
 )
 
 // iptablesRulesTmpl is a Go template string for generating iptables rules
-const iptablesRulesTmpl = `# Generated on {{ .CurrentDate }}
+const iptablesRulesTmpl = `# Generated on {{ .CurrentDate }}{{ if .IPv6 }} for ip6tables{{ end }}
 *filter
-{{- if $.Admins }}
+{{- /* without admins the ipv6 ruleset still drops, admins may only reach the host over ipv4 */}}
+{{- if or $.Admins $.IPv6 }}
 :INPUT DROP [0:0]
 {{- else }}
 :INPUT ACCEPT [0:0]
@@ -28,37 +37,55 @@ const iptablesRulesTmpl = `# Generated on {{ .CurrentDate }}
 -A INPUT -m conntrack --ctstate ESTABLISHED -j ACCEPT
 #LOCALHOST
 -A INPUT -i lo -j ACCEPT
+{{- if .IPv6 }}
+#ICMPV6 neighbor discovery and path mtu discovery
+-A INPUT -p ipv6-icmp -j ACCEPT
+{{- end }}
 
 {{- if $.Admins }}
 #ADMIN RULES
--A INPUT -s {{ .Admins }} -p tcp -m state --state NEW -m tcp -j ACCEPT
+{{- range $admin := .Admins }}
+-A INPUT {{ $.SourceMatch $admin.Source }}{{ $admin.Comment }} -p tcp -m state --state NEW -m tcp -j ACCEPT
+{{- end }}
 {{- end }}
 
 {{- if .PublicPortMetaData.HasPublicPorts }}
 #PUBLIC PORTS
--A INPUT -m state --state NEW -p tcp -m tcp -m multiport --dports {{ .PublicPortMetaData.PublicPorts }} -j ACCEPT
+{{- range $proto, $ports := .PublicPortMetaData.PortsByProto }}
+-A INPUT -m state --state NEW -p {{ $proto }} -m {{ $proto }} -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
 {{- end }}
 
 {{- if $.EntityDomains }}
 #ENTITY RULES
-{{- range .EntityDomains }}
--A INPUT -s {{ .IP }} -p tcp -m state --state NEW -m multiport --dports {{ .Ports }} -j ACCEPT
+{{- range $domain := .EntityDomains }}
+{{- range $ip := $domain.IPs }}
+{{- range $proto, $ports := $domain.PortsByProto }}
+-A INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $proto }} -m state --state NEW -m multiport --dports {{ $ports }} -j ACCEPT
+{{- end }}
+{{- end }}
 {{- end }}
 {{- end }}
 
 #allow specific hosts to ports
 {{- range $ip, $ports := $.MappedData2}}
-{{- range $portNumber := $ports}}
--A INPUT -s {{ $ip }} -p tcp -m state --state NEW -m tcp --dport {{ $portNumber }} -j ACCEPT
+{{- range $port := $ports}}
+-A INPUT {{ $.SourceMatch $ip }}{{ $.HostComment $ip }} -p {{ $port.Proto }} -m state --state NEW -m {{ $port.Proto }} --dport {{ $port.Range ":" }} -j ACCEPT
 {{- end}}
 {{- end}}
 
 
 -A OUTPUT -m state --state NEW,RELATED,ESTABLISHED -j ACCEPT
 -A OUTPUT -o lo -j ACCEPT
+{{- if .IPv6 }}
+-A OUTPUT -p ipv6-icmp -j ACCEPT
+{{- end }}
 
 {{- if .DockerInstalled }}
 -A FORWARD -j DOCKER-USER
+{{- if .IPv6 }}
+-A FORWARD -p ipv6-icmp -j ACCEPT
+{{- end }}
 -A FORWARD -j DOCKER-ISOLATION-STAGE-1
 -A FORWARD -o docker0 -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
 -A FORWARD -o docker0 -j DOCKER
@@ -66,92 +93,30 @@ const iptablesRulesTmpl = `# Generated on {{ .CurrentDate }}
 -A FORWARD -i docker0 -o docker0 -j ACCEPT
 
 {{range $id := .UniqueNetworkIDs}}
--A FORWARD -o br-{{ $id.ID }} -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
--A FORWARD -o br-{{ $id.ID }} -j DOCKER
--A FORWARD -i br-{{ $id.ID }} ! -o br-{{ $id.ID }} -j ACCEPT
--A FORWARD -i br-{{ $id.ID }} -o br-{{ $id.ID }} -j ACCEPT
+-A FORWARD -o {{ $id.Bridge }} -m conntrack --ctstate RELATED,ESTABLISHED -j ACCEPT
+-A FORWARD -o {{ $id.Bridge }} -j DOCKER
+-A FORWARD -i {{ $id.Bridge }} ! -o {{ $id.Bridge }} -j ACCEPT
+-A FORWARD -i {{ $id.Bridge }} -o {{ $id.Bridge }} -j ACCEPT
 {{end }}
+{{- range .ForwardSections }}
 
-#allow all admins to containers
-{{- range $container := .ContainerInfos}}
-{{- if eq $container.NetworkData.Name "docker0" }}
-{{- range .Ports}}
-{{- if $.Admins }}
--A DOCKER -s {{ $.Admins }} -d {{ $container.IPAddress }}/32 ! -i docker0 -o docker0 -p tcp -m tcp --dport {{ .PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- else}}
-{{- range .Ports}}
-{{- if $.Admins }}
--A DOCKER -s {{ $.Admins }} -d {{ $container.IPAddress }}/32 ! -i br-{{ $container.NetworkData.NetworkID }} -o br-{{ $container.NetworkData.NetworkID }} -p tcp -m tcp --dport {{ .PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-
-
-#allow specific entities to containers
-{{- range $container := $.ContainerInfos}}
-{{- if eq $container.NetworkData.Name "docker0" }}
-{{- range $port := .Ports}}
-{{- range $domain := $.EntityDomains}}
-{{- range $portNumber := $domain.PortsArr}}
-{{- if eq $port.PublicPort $portNumber }}
--A DOCKER -s {{ $domain.IP }} -d {{ $container.IPAddress }}/32 ! -i docker0 -o docker0 -p tcp -m tcp --dport {{ $port.PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- else}}
-{{- range $port := .Ports}}
-{{- range  $domain := $.EntityDomains}}
-{{- range $portNumber := $domain.PortsArr}}
-{{- if eq $port.PublicPort $portNumber }}
--A DOCKER -s {{ $domain.IP }} -d {{ $container.IPAddress }}/32 ! -i br-{{ $container.NetworkData.NetworkID }} -o br-{{ $container.NetworkData.NetworkID }} -p tcp -m tcp --dport {{ $port.PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-
-
-#allow specific hosts to containers
-{{- range $container := $.ContainerInfos}}
-{{- if eq $container.NetworkData.Name "docker0" }}
-{{- range $port := .Ports}}
-{{- range $ip, $ports := $.MappedData}}
-{{- range $portNumber := $ports}}
-{{- if eq $port.PublicPort $portNumber }}
--A DOCKER -s {{ $ip }} -d {{ $container.IPAddress }}/32 ! -i docker0 -o docker0 -p tcp -m tcp --dport {{ $port.PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- else}}
-{{- range $port := .Ports}}
-{{- range  $ip, $ports := $.MappedData}}
-{{- range $portNumber := $ports}}
-{{- if eq $port.PublicPort $portNumber }}
--A DOCKER -s {{ $ip }} -d {{ $container.IPAddress }}/32 ! -i br-{{ $container.NetworkData.NetworkID }} -o br-{{ $container.NetworkData.NetworkID }} -p tcp -m tcp --dport {{ $port.PrivatePort }} -j ACCEPT
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
-{{- end}}
+#{{ .Comment }}
+{{- range .Rules }}
+-A DOCKER {{ if .Source }}{{ $.SourceMatch .Source }}{{ .Comment }} {{ end }}-d {{ .Endpoint.IPAddress }}/{{ $.HostPrefixLen }} ! -i {{ .Endpoint.Bridge }} -o {{ .Endpoint.Bridge }} -p {{ .Port.Type }} -m {{ .Port.Type }} --dport {{ .Port.PrivatePort }} -j ACCEPT
+{{- end }}
+{{- end }}
 
 # docker isolation stage 1
 -A DOCKER-ISOLATION-STAGE-1 -i docker0 ! -o docker0 -j DOCKER-ISOLATION-STAGE-2
 {{- range $id := .UniqueNetworkIDs}}
--A DOCKER-ISOLATION-STAGE-1 -i br-{{ $id.ID }} ! -o br-{{ $id.ID }} -j DOCKER-ISOLATION-STAGE-2
+-A DOCKER-ISOLATION-STAGE-1 -i {{ $id.Bridge }} ! -o {{ $id.Bridge }} -j DOCKER-ISOLATION-STAGE-2
 {{- end }}
 -A DOCKER-ISOLATION-STAGE-1 -j RETURN
 
 # docker isolation stage 2
 -A DOCKER-ISOLATION-STAGE-2 -o docker0 -j DROP
 {{- range $id := .UniqueNetworkIDs}}
--A DOCKER-ISOLATION-STAGE-2 -o br-{{ $id.ID }} -j DROP
+-A DOCKER-ISOLATION-STAGE-2 -o {{ $id.Bridge }} -j DROP
 {{- end }}
 -A DOCKER-ISOLATION-STAGE-2 -j RETURN
 -A DOCKER-USER -j RETURN
@@ -167,26 +132,27 @@ COMMIT
 :POSTROUTING ACCEPT [0:0]
 :DOCKER - [0:0]
 -A PREROUTING -m addrtype --dst-type LOCAL -j DOCKER
--A OUTPUT ! -d 127.0.0.0/8 -m addrtype --dst-type LOCAL -j DOCKER
+-A OUTPUT ! -d {{ .LoopbackNet }} -m addrtype --dst-type LOCAL -j DOCKER
 
--A POSTROUTING -s 172.17.0.0/16 ! -o docker0 -j MASQUERADE
+{{ if .DefaultBridgeSubnet -}}
+-A POSTROUTING -s {{ .DefaultBridgeSubnet }} ! -o docker0 -j MASQUERADE
+{{- end }}
 {{- range $id := .UniqueNetworkIDs}}
--A POSTROUTING -s {{ $id.Subnet }} ! -o br-{{ $id.ID }} -j MASQUERADE
+{{- /* networks without ipam config have no subnet to masquerade */}}
+{{- if $id.Subnet }}
+-A POSTROUTING -s {{ $id.Subnet }} ! -o {{ $id.Bridge }} -j MASQUERADE
+{{- end }}
 {{- end }}
 
 -A DOCKER -i docker0 -j RETURN
 {{- range $id := .UniqueNetworkIDs}}
--A DOCKER -i br-{{ $id.ID }} -j RETURN
+-A DOCKER -i {{ $id.Bridge }} -j RETURN
 {{- end }}
 
 {{- range $container := .ContainerInfos}}
-{{- if eq $container.NetworkData.Name "docker0" }}
-{{- range .Ports}}
--A DOCKER ! -i docker0 -p tcp -m tcp --dport {{ .PublicPort }} -j DNAT --to-destination {{ $container.IPAddress }}:{{ .PrivatePort }}
-{{- end}}
-{{- else}}
-{{- range .Ports}}
--A DOCKER ! -i br-{{ $container.NetworkData.NetworkID }} -p tcp -m tcp --dport {{ .PublicPort }} -j DNAT --to-destination {{ $container.IPAddress }}:{{ .PrivatePort }}
+{{- range $endpoint := .Endpoints}}
+{{- range $container.Ports}}
+-A DOCKER ! -i {{ $endpoint.Bridge }} -p {{ .Type }} -m {{ .Type }} --dport {{ .PublicPort }} -j DNAT --to-destination {{ $.DNATAddress $endpoint.IPAddress }}:{{ .PrivatePort }}
 {{- end}}
 {{- end}}
 {{- end}}
@@ -209,7 +175,139 @@ func GenerateIPTablesRules(data structs.Data) (string, error) {
 	return buf.String(), nil
 }
 
-func ApplyIPTablesRules(filePath string) ([]byte, error) {
-	cmd := exec.Command("bash", config.ScriptPath, filePath)
-	return cmd.Output()
+// Ruleset is a rendered ruleset, iptables needs a second one for ip6tables
+// while the nftables inet table handles both families
+type Ruleset struct {
+	Rules     string
+	IPv6Rules string // empty for the nftables backend
+	IPSets    string // ipset restore script, empty when ipsets are not used
+}
+
+// GenerateRules renders the ruleset with the template of the configured backend and iptables mode
+func GenerateRules(cfg *config.Config, data structs.Data) (Ruleset, error) {
+	switch cfg.Backend {
+	case BackendIPTables:
+		generate := GenerateIPTablesRules
+		switch cfg.IptablesMode {
+		case ModeTables:
+		case ModeChains:
+			generate = GenerateIPTablesChains
+		case ModeDockerUser:
+			generate = GenerateIPTablesDockerUser
+		default:
+			return Ruleset{}, fmt.Errorf("unknown iptables mode %q", cfg.IptablesMode)
+		}
+		ipv4Data, ipv6Data := FilterFamily(data, false), FilterFamily(data, true)
+		var ipSets string
+		if cfg.IpsetBinary != "" {
+			ipv4Data, ipv6Data = withIPSets(ipv4Data), withIPSets(ipv6Data)
+			ipSets = GenerateIPSets(append(ipv4Data.IPSets, ipv6Data.IPSets...))
+		}
+		rules, err := generate(ipv4Data)
+		if err != nil {
+			return Ruleset{}, err
+		}
+		ipv6Rules, err := generate(ipv6Data)
+		if err != nil {
+			return Ruleset{}, err
+		}
+		return Ruleset{Rules: rules, IPv6Rules: ipv6Rules, IPSets: ipSets}, nil
+	case BackendNftables:
+		rules, err := GenerateNftablesRules(data)
+		return Ruleset{Rules: rules}, err
+	}
+	return Ruleset{}, fmt.Errorf("unknown firewall backend %q", cfg.Backend)
+}
+
+// RulesFile returns the file where the ruleset of the configured backend is saved
+func RulesFile(cfg *config.Config) string {
+	if cfg.Backend == BackendNftables {
+		return cfg.NftRulesFile
+	}
+	return cfg.IptablesRulesFile
+}
+
+// writeToFile writes content to a file specified by the filePath parameter.
+func writeToFile(filePath, content string) error {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	return err
+}
+
+// WriteRules saves the ruleset to the rules files of the configured backend
+func WriteRules(cfg *config.Config, ruleset Ruleset) error {
+	if err := writeToFile(RulesFile(cfg), ruleset.Rules); err != nil {
+		return err
+	}
+	if ruleset.IPv6Rules != "" {
+		if err := writeToFile(cfg.Ip6tablesRulesFile, ruleset.IPv6Rules); err != nil {
+			return err
+		}
+	}
+	return WriteIPSets(cfg, ruleset)
+}
+
+// restoreIPTables pipes an iptables ruleset to binary, with --noflush when the mode needs it
+// and then without the jumps already found in live
+func restoreIPTables(cfg *config.Config, binary string, rules, live []byte) ([]byte, error) {
+	if NoFlush(cfg) {
+		return runRestore(binary, withoutLiveJumps(rules, live), "--noflush")
+	}
+	return runRestore(binary, rules)
+}
+
+// ApplyRules pipes the rules files saved by WriteRules to the restore command of the configured
+// backend. For iptables the ipv4 rules are restored when the ipv6 ones fail so both families stay
+// in sync, ipv6 is left alone when no ip6tables-restore binary is configured. The ipsets are
+// filled first and the fw- sets no longer used are destroyed last. A rejected ruleset is reported as a *RestoreError with the failing line.
+func ApplyRules(cfg *config.Config) ([]byte, error) {
+	rules, err := os.ReadFile(RulesFile(cfg))
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Backend {
+	case BackendIPTables:
+		if output, err := ApplyIPSets(cfg); err != nil {
+			return output, err
+		}
+		var snapshot []byte
+		if cfg.Ip6tablesRestoreBinary != "" || NoFlush(cfg) {
+			if snapshot, err = exec.Command(cfg.IptablesSaveBinary).Output(); err != nil {
+				return nil, fmt.Errorf("saving current ipv4 ruleset: %w", err)
+			}
+		}
+		output, err := restoreIPTables(cfg, cfg.IptablesRestoreBinary, rules, snapshot)
+		if err != nil {
+			return output, err
+		}
+		if cfg.Ip6tablesRestoreBinary != "" {
+			ipv6Rules, err := os.ReadFile(cfg.Ip6tablesRulesFile)
+			var ipv6Live []byte
+			if err == nil && NoFlush(cfg) {
+				ipv6Live, err = exec.Command(cfg.Ip6tablesSaveBinary).Output()
+			}
+			if err == nil {
+				_, err = restoreIPTables(cfg, cfg.Ip6tablesRestoreBinary, ipv6Rules, ipv6Live)
+			}
+			if err != nil {
+				if _, restoreErr := runRestore(cfg.IptablesRestoreBinary, snapshot); restoreErr != nil {
+					return output, fmt.Errorf("applying ipv6 rules: %v (restoring previous ipv4 ruleset failed: %v)", err, restoreErr)
+				}
+				return output, fmt.Errorf("applying ipv6 rules: %w, previous ipv4 ruleset restored", err)
+			}
+		}
+		// the sets of port lists the new rules no longer match are destroyed
+		if script, err := os.ReadFile(cfg.IpsetRulesFile); err == nil || os.IsNotExist(err) {
+			destroyStaleIPSets(cfg, string(script))
+		}
+		return output, nil
+	case BackendNftables:
+		return runRestore(cfg.NftBinary, rules, "-f", "-")
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", cfg.Backend)
 }
@@ -0,0 +1,210 @@
+package utils
+
+import (
+	"firewall_script_docker/config"
+	"firewall_script_docker/structs"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"os/exec"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ipset names, 6 is appended for ipv6. A set of sources allowed to the same ports is named
+// after a hash of these ports so its members can change without changing the rules.
+const (
+	ipsetPrefix   = "fw-"
+	adminsSet     = "fw-admins"
+	entitiesSet   = "fw-ent"
+	authorizedSet = "fw-auth"
+	hostsSet      = "fw-host"
+)
+
+// portsKey sorts ports and returns them with the key naming their set
+func portsKey(ports []structs.Port) ([]structs.Port, string) {
+	sorted := slices.Clone(ports)
+	slices.SortFunc(sorted, func(a, b structs.Port) int {
+		if a.Proto != b.Proto {
+			return strings.Compare(a.Proto, b.Proto)
+		}
+		return int(a.Number) - int(b.Number)
+	})
+	var written []string
+	for _, port := range sorted {
+		written = append(written, port.Proto+":"+port.Range("-"))
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(strings.Join(written, ",")))
+	return sorted, fmt.Sprintf("%08x", hash.Sum32())
+}
+
+// sourceGroups groups the sources of a map of ips and ports into one set per port list,
+// returning the map of set names and ports and the sets
+func sourceGroups(prefix, suffix, family string, mappedData map[string][]structs.Port) (map[string][]structs.Port, []structs.IPSet) {
+	if mappedData == nil {
+		return nil, nil
+	}
+	grouped := make(map[string][]structs.Port)
+	members := make(map[string][]string)
+	for ip, ports := range mappedData {
+		if len(ports) == 0 {
+			continue
+		}
+		sorted, key := portsKey(ports)
+		name := prefix + suffix + "-" + key
+		grouped[name] = sorted
+		members[name] = append(members[name], ip)
+	}
+	var sets []structs.IPSet
+	for name, ips := range members {
+		sort.Strings(ips)
+		sets = append(sets, structs.IPSet{Name: name, Family: family, Members: ips})
+	}
+	return grouped, sets
+}
+
+// withIPSets moves the admins, entity domains and authorized ips of data filtered by FilterFamily
+// into ipsets, the templates then match the set names with SourceMatch
+func withIPSets(data structs.Data) structs.Data {
+	family, suffix := "inet", ""
+	if data.IPv6 {
+		family, suffix = "inet6", "6"
+	}
+	withSets := data
+	withSets.IPSets = nil
+
+	if len(data.Admins) > 0 {
+		withSets.Admins = []structs.Admin{{Source: adminsSet + suffix}}
+		withSets.IPSets = append(withSets.IPSets, structs.IPSet{Name: adminsSet + suffix, Family: family, Members: data.AdminSources()})
+	}
+
+	entities := make(map[string][]structs.Port)
+	for _, domain := range data.EntityDomains {
+		for _, ip := range domain.IPs {
+			entities[ip] = domain.PortsArr
+		}
+	}
+	grouped, sets := sourceGroups(entitiesSet, suffix, family, entities)
+	withSets.IPSets = append(withSets.IPSets, sets...)
+	withSets.EntityDomains = nil
+	for name, ports := range grouped {
+		withSets.EntityDomains = append(withSets.EntityDomains, structs.AccessDomain{Name: name, IPs: []string{name}, PortsArr: ports})
+	}
+	sort.Slice(withSets.EntityDomains, func(i, j int) bool { return withSets.EntityDomains[i].Name < withSets.EntityDomains[j].Name })
+
+	withSets.MappedData, sets = sourceGroups(authorizedSet, suffix, family, data.MappedData)
+	withSets.IPSets = append(withSets.IPSets, sets...)
+	withSets.MappedData2, sets = sourceGroups(hostsSet, suffix, family, data.MappedData2)
+	withSets.IPSets = append(withSets.IPSets, sets...)
+
+	sort.Slice(withSets.IPSets, func(i, j int) bool { return withSets.IPSets[i].Name < withSets.IPSets[j].Name })
+	return withSets
+}
+
+// GenerateIPSets renders an ipset restore script filling every set. The members go to a
+// temporary set swapped with the live one, so the rules never see a half filled set.
+func GenerateIPSets(sets []structs.IPSet) string {
+	var b strings.Builder
+	for _, set := range sets {
+		tmp := set.Name + "-tmp"
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", set.Name, set.Family)
+		fmt.Fprintf(&b, "create %s hash:net family %s -exist\n", tmp, set.Family)
+		fmt.Fprintf(&b, "flush %s\n", tmp)
+		for _, member := range set.Members {
+			fmt.Fprintf(&b, "add %s %s -exist\n", tmp, member)
+		}
+		fmt.Fprintf(&b, "swap %s %s\n", tmp, set.Name)
+		fmt.Fprintf(&b, "destroy %s\n", tmp)
+	}
+	return b.String()
+}
+
+// WriteIPSets saves the ipset script of the ruleset, nothing is written when ipsets are not used
+func WriteIPSets(cfg *config.Config, ruleset Ruleset) error {
+	if cfg.IpsetBinary == "" {
+		return nil
+	}
+	return writeToFile(cfg.IpsetRulesFile, ruleset.IPSets)
+}
+
+// ApplyIPSets pipes the ipset script saved by WriteIPSets to ipset restore, the sets have to
+// exist before the rules matching them are restored
+func ApplyIPSets(cfg *config.Config) ([]byte, error) {
+	if cfg.IpsetBinary == "" {
+		return nil, nil
+	}
+	if !IsIpsetInstalled(cfg.IpsetBinary) {
+		return nil, fmt.Errorf("ipset binary %s not found", cfg.IpsetBinary)
+	}
+	script, err := os.ReadFile(cfg.IpsetRulesFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return runRestore(cfg.IpsetBinary, script, "restore")
+}
+
+// SaveIPSets returns an ipset restore script filling the fw- sets back with their live members,
+// empty when ipsets are not used
+func SaveIPSets(cfg *config.Config) (string, error) {
+	if cfg.IpsetBinary == "" || !IsIpsetInstalled(cfg.IpsetBinary) {
+		return "", nil
+	}
+	live, err := exec.Command(cfg.IpsetBinary, "save").Output()
+	if err != nil {
+		return "", err
+	}
+	return GenerateIPSets(parseIPSets(string(live))), nil
+}
+
+// parseIPSets returns the fw- sets of an ipset save output, the temporary sets are left out
+func parseIPSets(saved string) []structs.IPSet {
+	var sets []structs.IPSet
+	index := make(map[string]int)
+	for _, line := range strings.Split(saved, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || !strings.HasPrefix(fields[1], ipsetPrefix) || strings.HasSuffix(fields[1], "-tmp") {
+			continue
+		}
+		switch fields[0] {
+		case "create":
+			set := structs.IPSet{Name: fields[1], Family: "inet"}
+			if i := slices.Index(fields, "family"); i >= 0 && i+1 < len(fields) {
+				set.Family = fields[i+1]
+			}
+			index[set.Name] = len(sets)
+			sets = append(sets, set)
+		case "add":
+			if i, found := index[fields[1]]; found {
+				sets[i].Members = append(sets[i].Members, fields[2])
+			}
+		}
+	}
+	return sets
+}
+
+// destroyStaleIPSets destroys the live fw- sets that script doesn't create, once the restored
+// rules no longer match them. A set still in use, e.g. by a rule added by hand, can't be
+// destroyed and is left in place.
+func destroyStaleIPSets(cfg *config.Config, script string) {
+	if cfg.IpsetBinary == "" || !IsIpsetInstalled(cfg.IpsetBinary) {
+		return
+	}
+	live, err := exec.Command(cfg.IpsetBinary, "list", "-name").Output()
+	if err != nil {
+		return
+	}
+	used := make(map[string]bool)
+	for _, set := range parseIPSets(script) {
+		used[set.Name] = true
+	}
+	for _, name := range strings.Fields(string(live)) {
+		if strings.HasPrefix(name, ipsetPrefix) && !used[name] {
+			exec.Command(cfg.IpsetBinary, "destroy", name).Run()
+		}
+	}
+}
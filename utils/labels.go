@@ -0,0 +1,114 @@
+package utils
+
+import (
+	"firewall_script_docker/structs"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// container labels declaring who can reach its published ports, e.g. in a compose file
+//
+//	labels:
+//	  firewall.allow: office,partner.example.com
+//	  firewall.ports: 443/tcp
+const (
+	LabelAllow  = "firewall.allow"  // policy groups or hosts allowed to the ports
+	LabelPublic = "firewall.public" // true opens the ports to everyone
+	LabelPorts  = "firewall.ports"  // container ports the labels apply to, every published port when unset
+)
+
+// labelAccess reads the firewall labels of a container, false when they give no access.
+// Invalid values are ignored, a firewall.ports label without a valid port gives no access
+// instead of opening every published port.
+func labelAccess(labels map[string]string) (structs.ContainerAccess, bool) {
+	var access structs.ContainerAccess
+	for _, name := range strings.Split(labels[LabelAllow], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			access.Allow = append(access.Allow, name)
+		}
+	}
+	access.Public, _ = strconv.ParseBool(labels[LabelPublic])
+	if ports := strings.TrimSpace(labels[LabelPorts]); ports != "" {
+		if access.Ports = ParsePorts(ports); len(access.Ports) == 0 {
+			return access, false
+		}
+	}
+	return access, access.Public || len(access.Allow) > 0
+}
+
+// ValidateContainerLabels reports the bad ports of the firewall.ports labels of the containers
+func ValidateContainerLabels(containers []structs.ContainerInfo) []Diagnostic {
+	var diagnostics []Diagnostic
+	for _, container := range containers {
+		ports, found := container.Labels[LabelPorts]
+		if !found {
+			continue
+		}
+		at := Diagnostic{File: "container " + container.Name}
+		for _, token := range strings.Split(ports, ",") {
+			if _, isValid := ParsePort(token); !isValid {
+				at.Reason = fmt.Sprintf(LabelPorts+" label: "+badPortReason, strings.TrimSpace(token))
+				diagnostics = append(diagnostics, at)
+			}
+		}
+		if len(ParsePorts(ports)) == 0 {
+			at.Reason = LabelPorts + " label has no valid port, the other firewall labels of the container are ignored"
+			diagnostics = append(diagnostics, at)
+		}
+	}
+	return diagnostics
+}
+
+// ResolveContainerAccess sets the access of the containers from their firewall.* labels and the
+// container rules of the policy selecting them, resolving the allowed names to their addresses.
+// A name is a group of the policy when groups has it and a host otherwise. It returns the
+// hostname each address was resolved from.
+func ResolveContainerAccess(containers []structs.ContainerInfo, groups map[string][]string, rules []structs.ContainerRule) map[string]string {
+	hostNames := make(map[string]string)
+	for i := range containers {
+		container := &containers[i]
+		container.Access = nil
+		if access, found := labelAccess(container.Labels); found {
+			container.Access = append(container.Access, access)
+		}
+		for _, rule := range rules {
+			if slices.ContainsFunc(rule.Containers, container.Selects) {
+				container.Access = append(container.Access, rule.Access)
+			}
+		}
+		for j := range container.Access {
+			container.Access[j].Sources = resolveAllowed(container.Access[j].Allow, groups, hostNames)
+		}
+	}
+	return hostNames
+}
+
+// resolveAllowed returns the addresses of the groups or hosts of allow, recording in hostNames
+// the hostname each address was resolved from
+func resolveAllowed(allow []string, groups map[string][]string, hostNames map[string]string) []string {
+	var sources []string
+	for _, name := range allow {
+		hosts, isGroup := groups[name]
+		if !isGroup {
+			hosts = []string{name}
+		}
+		for _, host := range hosts {
+			ips, err := LookupHost(host)
+			if err != nil {
+				continue
+			}
+			for _, ip := range ips {
+				if slices.Contains(sources, ip) {
+					continue
+				}
+				sources = append(sources, ip)
+				if isHostname(host) {
+					hostNames[ip] = host
+				}
+			}
+		}
+	}
+	return sources
+}
@@ -0,0 +1,251 @@
+package utils
+
+import (
+	"bytes"
+	"firewall_script_docker/structs"
+	"fmt"
+	"slices"
+	"sort"
+	"text/template"
+)
+
+// nftablesRulesTmpl is a Go template string for generating an nft -f ruleset
+// equivalent to iptablesRulesTmpl, for both families at once
+const nftablesRulesTmpl = `#!/usr/sbin/nft -f
+# Generated on {{ .CurrentDate }}
+
+# declare the tables first so the deletes below never fail on a fresh host
+table inet filter
+delete table inet filter
+{{- if .DockerInstalled }}
+{{- range .Families }}
+table {{ .Proto }} nat
+delete table {{ .Proto }} nat
+{{- end }}
+{{- end }}
+
+table inet filter {
+{{- range .Families }}
+{{- if .Admins }}
+	# hosts that have access to everything in the server
+	set admins{{ .Suffix }} {
+		type {{ .AddrType }}
+		flags interval
+		auto-merge
+		elements = {
+{{- range .AdminSources }}
+			{{ . }},
+{{- end }}
+		}
+	}
+{{- end }}
+{{- if .EntityElements }}
+
+	# hosts that have access to some particular ports in the server
+	set entities{{ .Suffix }} {
+		type {{ .AddrType }} . inet_proto . inet_service
+		flags interval
+		elements = {
+{{- range .EntityElements }}
+			{{ . }},
+{{- end }}
+		}
+	}
+{{- end }}
+{{- if .AuthorizedElements }}
+
+	# hosts that have access to server ports not published by a container
+	set authorized{{ .Suffix }} {
+		type {{ .AddrType }} . inet_proto . inet_service
+		flags interval
+		elements = {
+{{- range .AuthorizedElements }}
+			{{ . }},
+{{- end }}
+		}
+	}
+{{- end }}
+{{- end }}
+
+	chain input {
+		type filter hook input priority filter; policy {{ if .Admins }}drop{{ else }}accept{{ end }};
+		ct state established,related accept
+		iif lo accept
+		# neighbor discovery and path mtu discovery
+		meta l4proto ipv6-icmp accept
+{{- range .Families }}
+{{- if .Admins }}
+		{{ .Proto }} saddr @admins{{ .Suffix }} ct state new meta l4proto tcp accept
+{{- end }}
+{{- end }}
+{{- range $proto, $ports := .PublicPorts }}
+		ct state new {{ $proto }} dport { {{ $ports }} } accept
+{{- end }}
+{{- range .Families }}
+{{- if .EntityElements }}
+		ct state new {{ .Proto }} saddr . meta l4proto . th dport @entities{{ .Suffix }} accept
+{{- end }}
+{{- if .AuthorizedElements }}
+		ct state new {{ .Proto }} saddr . meta l4proto . th dport @authorized{{ .Suffix }} accept
+{{- end }}
+{{- end }}
+	}
+
+	chain forward {
+		type filter hook forward priority filter; policy drop;
+{{- if .DockerInstalled }}
+		ct state established,related accept
+		meta l4proto ipv6-icmp accept
+
+		# containers may reach the outside and their own network only
+{{- range .Bridges }}
+		iifname "{{ . }}" oifname "{{ . }}" accept
+		iifname "{{ . }}" oifname != { {{ $.BridgeList }} } accept
+{{- end }}
+{{- range $family := .Families }}
+{{- range $family.Sections }}
+
+		#{{ .Comment }}
+{{- range .Rules }}
+		{{ if .Source }}{{ $family.Proto }} saddr {{ .Source }} {{ end }}{{ $family.Proto }} daddr {{ .Endpoint.IPAddress }} oifname "{{ .Endpoint.Bridge }}" {{ .Port.Type }} dport {{ .Port.PrivatePort }} accept
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+	}
+
+	chain output {
+		type filter hook output priority filter; policy accept;
+	}
+}
+{{- if .DockerInstalled }}
+{{- range $family := .Families }}
+
+# NAT for docker to access docker container
+table {{ .Proto }} nat {
+	chain prerouting {
+		type nat hook prerouting priority dstnat; policy accept;
+		fib daddr type local jump docker
+	}
+
+	chain output {
+		type nat hook output priority -100; policy accept;
+		{{ .Proto }} daddr != {{ .LoopbackNet }} fib daddr type local jump docker
+	}
+
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+{{- if .DefaultBridgeSubnet }}
+		{{ .Proto }} saddr {{ .DefaultBridgeSubnet }} oifname != "docker0" masquerade
+{{- end }}
+{{- range .UniqueNetworkIDs }}
+{{- if .Subnet }}
+		{{ $family.Proto }} saddr {{ .Subnet }} oifname != "{{ .Bridge }}" masquerade
+{{- end }}
+{{- end }}
+	}
+
+	chain docker {
+{{- range $.Bridges }}
+		iifname "{{ . }}" return
+{{- end }}
+{{- range $container := .ContainerInfos }}
+{{- range $endpoint := .Endpoints }}
+{{- range $container.Ports }}
+		iifname != "{{ $endpoint.Bridge }}" {{ .Type }} dport {{ .PublicPort }} dnat to {{ $family.DNATAddress $endpoint.IPAddress }}:{{ .PrivatePort }}
+{{- end }}
+{{- end }}
+{{- end }}
+	}
+}
+{{- end }}
+{{- end }}
+`
+
+// nftablesFamily is the part of the data of one family with the names nft uses for it
+type nftablesFamily struct {
+	structs.Data                // filtered by FilterFamily
+	Proto              string   // ip or ip6, the nft payload protocol and nat table family
+	AddrType           string   // ipv4_addr or ipv6_addr, the type of the set elements
+	Suffix             string   // appended to the set names, 6 for ipv6
+	EntityElements     []string // ip . protocol . port elements of the entities set
+	AuthorizedElements []string // ip . protocol . port elements of the authorized set
+	// container rules, the admins are matched by their set
+	Sections []structs.RuleSection
+}
+
+// nftablesData adds the values precomputed for the nftables template to structs.Data
+type nftablesData struct {
+	structs.Data
+	Families   []nftablesFamily // ipv4 then ipv6
+	Bridges    []string         // docker0 and the bridges of every custom network
+	BridgeList string           // Bridges quoted and comma separated for anonymous sets
+	// public ports joined by protocol with nft port ranges
+	PublicPorts map[string]string
+}
+
+// newNftablesFamily filters data by family and computes its set elements
+func newNftablesFamily(data structs.Data, ipv6 bool) nftablesFamily {
+	family := nftablesFamily{Data: FilterFamily(data, ipv6), Proto: "ip", AddrType: "ipv4_addr"}
+	if ipv6 {
+		family.Proto, family.AddrType, family.Suffix = "ip6", "ipv6_addr", "6"
+	}
+	for _, domain := range family.EntityDomains {
+		for _, ip := range domain.IPs {
+			for _, port := range domain.PortsArr {
+				family.EntityElements = append(family.EntityElements, fmt.Sprintf("%s . %s . %s", ip, port.Proto, port.Range("-")))
+			}
+		}
+	}
+	for ip, ports := range family.MappedData2 {
+		for _, port := range ports {
+			family.AuthorizedElements = append(family.AuthorizedElements, fmt.Sprintf("%s . %s . %s", ip, port.Proto, port.Range("-")))
+		}
+	}
+	// map iteration order is random, keep the rendered ruleset stable
+	sort.Strings(family.AuthorizedElements)
+	adminSet := family.Data
+	adminSet.Admins = nil
+	if len(family.Admins) > 0 {
+		adminSet.Admins = []structs.Admin{{Source: "@admins" + family.Suffix}}
+	}
+	family.Sections = adminSet.ForwardSections()
+	return family
+}
+
+// newNftablesData computes the families, bridge names and public ports used by nftablesRulesTmpl
+func newNftablesData(data structs.Data) nftablesData {
+	nftData := nftablesData{Data: data, PublicPorts: structs.GroupPorts(data.PublicPortMetaData.Ports, "-")}
+	nftData.Families = []nftablesFamily{newNftablesFamily(data, false), newNftablesFamily(data, true)}
+	nftData.Bridges = append(nftData.Bridges, "docker0")
+	for _, family := range nftData.Families {
+		for _, network := range family.UniqueNetworkIDs {
+			if !slices.Contains(nftData.Bridges, network.Bridge) {
+				nftData.Bridges = append(nftData.Bridges, network.Bridge)
+			}
+		}
+	}
+	for i, bridge := range nftData.Bridges {
+		if i > 0 {
+			nftData.BridgeList += ", "
+		}
+		nftData.BridgeList += fmt.Sprintf("%q", bridge)
+	}
+	return nftData
+}
+
+// GenerateNftablesRules renders data as a ruleset to be loaded with nft -f
+func GenerateNftablesRules(data structs.Data) (string, error) {
+	tmpl, err := template.New("nftables").Parse(nftablesRulesTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, newNftablesData(data))
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// resolvedHost is the last good answer for a host
+type resolvedHost struct {
+	addresses []string
+	expires   time.Time
+	lastUsed  time.Time
+}
+
+// Resolver caches the addresses of hostnames until their dns ttl expires. When a lookup fails
+// the last good answer is kept and retried after MinTTL instead of dropping the host.
+type Resolver struct {
+	MinTTL time.Duration // ttls are raised to MinTTL so short ones don't regenerate too often
+	MaxTTL time.Duration // and lowered to MaxTTL
+
+	mu     sync.Mutex
+	hosts  map[string]*resolvedHost
+	lookup func(host string) ([]string, time.Duration, error)
+}
+
+// NewResolver returns a resolver asking lookup for the addresses of a host and their ttl
+func NewResolver(lookup func(host string) ([]string, time.Duration, error)) *Resolver {
+	return &Resolver{
+		MinTTL: 30 * time.Second,
+		MaxTTL: time.Hour,
+		hosts:  make(map[string]*resolvedHost),
+		lookup: lookup,
+	}
+}
+
+// hostResolver resolves the hostnames of the access files and the policy
+var hostResolver = NewResolver(lookupWithTTL)
+
+// update stores the answer of lookup for host, keeping the previous answer on failure. It is
+// called with r.mu held, the lookups themselves run without it.
+func (r *Resolver) update(host string, addresses []string, ttl time.Duration, err error, now time.Time) (*resolvedHost, error) {
+	previous := r.hosts[host]
+	if err == nil && len(addresses) == 0 {
+		err = fmt.Errorf("no address found for %s", host)
+	}
+	if err != nil {
+		if previous == nil {
+			return nil, err
+		}
+		previous.expires = now.Add(r.MinTTL)
+		return previous, nil
+	}
+	ttl = max(r.MinTTL, min(ttl, r.MaxTTL))
+	resolved := &resolvedHost{addresses: addresses, expires: now.Add(ttl)}
+	if previous != nil {
+		resolved.lastUsed = previous.lastUsed
+	}
+	r.hosts[host] = resolved
+	return resolved, nil
+}
+
+// Lookup returns the addresses of host, resolving it when it is not cached or expired
+func (r *Resolver) Lookup(host string) ([]string, error) {
+	now := time.Now()
+	r.mu.Lock()
+	if resolved, found := r.hosts[host]; found && now.Before(resolved.expires) {
+		resolved.lastUsed = now
+		addresses := slices.Clone(resolved.addresses)
+		r.mu.Unlock()
+		return addresses, nil
+	}
+	r.mu.Unlock()
+
+	addresses, ttl, err := r.lookup(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resolved, err := r.update(host, addresses, ttl, err, now)
+	if err != nil {
+		return nil, err
+	}
+	resolved.lastUsed = now
+	return slices.Clone(resolved.addresses), nil
+}
+
+// Refresh resolves the expired hosts again and reports whether the addresses of one changed
+func (r *Resolver) Refresh() bool {
+	now := time.Now()
+	r.mu.Lock()
+	var expired []string
+	for host, resolved := range r.hosts {
+		if !now.Before(resolved.expires) {
+			expired = append(expired, host)
+		}
+	}
+	r.mu.Unlock()
+
+	changed := false
+	for _, host := range expired {
+		addresses, ttl, err := r.lookup(host)
+		r.mu.Lock()
+		// a host pruned during the lookup left the access files
+		if previous, found := r.hosts[host]; found {
+			previousAddresses := previous.addresses
+			resolved, _ := r.update(host, addresses, ttl, err, now)
+			if !sameAddresses(previousAddresses, resolved.addresses) {
+				changed = true
+			}
+		}
+		r.mu.Unlock()
+	}
+	return changed
+}
+
+// NextExpiry returns when the first cached host expires, false when nothing is cached
+func (r *Resolver) NextExpiry() (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var next time.Time
+	for _, resolved := range r.hosts {
+		if next.IsZero() || resolved.expires.Before(next) {
+			next = resolved.expires
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Prune forgets the hosts that were not looked up since before, they left the access files
+func (r *Resolver) Prune(before time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for host, resolved := range r.hosts {
+		if resolved.lastUsed.Before(before) {
+			delete(r.hosts, host)
+		}
+	}
+}
+
+// sameAddresses reports whether two answers hold the same addresses in any order
+func sameAddresses(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// WatchHosts calls onChange every time a resolved hostname of the access files expires and
+// resolves to other addresses, until ctx is done
+func WatchHosts(ctx context.Context, onChange func()) {
+	for {
+		wait := hostResolver.MaxTTL
+		if next, found := hostResolver.NextExpiry(); found {
+			wait = time.Until(next)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if hostResolver.Refresh() {
+			onChange()
+		}
+	}
+}
+
+// PruneHosts forgets the hostnames that were not looked up since before
+func PruneHosts(before time.Time) {
+	hostResolver.Prune(before)
+}
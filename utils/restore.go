@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RestoreError is returned when iptables-restore, ip6tables-restore or nft rejects a ruleset
+type RestoreError struct {
+	Binary string
+	Line   int    // line of the ruleset reported by the binary, 0 when it reported none
+	Rule   string // text of that line
+	Stderr string
+	Err    error
+}
+
+func (e *RestoreError) Error() string {
+	stderr := strings.TrimSpace(e.Stderr)
+	if e.Line > 0 {
+		return fmt.Sprintf("%s failed at line %d %q: %s", e.Binary, e.Line, e.Rule, stderr)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Binary, e.Err, stderr)
+}
+
+func (e *RestoreError) Unwrap() error {
+	return e.Err
+}
+
+var (
+	// iptables-restore reports "line 12 failed" or "Error occurred at line: 12"
+	restoreLine = regexp.MustCompile(`line:? (\d+)`)
+	// nft reports "/dev/stdin:12:5-10: Error: ..."
+	nftLine = regexp.MustCompile(`(?m)^\S+?:(\d+):\d+(-\d+)?: Error`)
+)
+
+// newRestoreError finds the line of the ruleset the binary complained about in its stderr
+func newRestoreError(binary string, rules []byte, stderr string, err error) *RestoreError {
+	restoreErr := &RestoreError{Binary: binary, Stderr: stderr, Err: err}
+	for _, pattern := range []*regexp.Regexp{nftLine, restoreLine} {
+		if match := pattern.FindStringSubmatch(stderr); match != nil {
+			restoreErr.Line, _ = strconv.Atoi(match[1])
+			break
+		}
+	}
+	lines := strings.Split(string(rules), "\n")
+	if restoreErr.Line > 0 && restoreErr.Line <= len(lines) {
+		restoreErr.Rule = strings.TrimSpace(lines[restoreErr.Line-1])
+	}
+	return restoreErr
+}
+
+// runRestore pipes rules to a restore command and returns its stdout, warnings written to stderr
+// by a successful restore are passed on to our stderr
+func runRestore(binary string, rules []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command(binary, args...)
+	cmd.Stdin = bytes.NewReader(rules)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.Bytes(), newRestoreError(binary, rules, stderr.String(), err)
+	}
+	os.Stderr.Write(stderr.Bytes())
+	return stdout.Bytes(), nil
+}
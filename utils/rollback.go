@@ -0,0 +1,193 @@
+package utils
+
+import (
+	"context"
+	"firewall_script_docker/config"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// RollbackOptions configures ApplyRulesWithRollback
+type RollbackOptions struct {
+	Timeout   time.Duration   // how long to wait for a confirmation before restoring the previous ruleset
+	ProbeAddr string          // address of the tcp probe listener (e.g. ":9999"), empty disables the probe
+	AdminIPs  []string        // a probe connection confirms the ruleset only when it comes from one of these ips
+	Context   context.Context // cancelling it restores the previous ruleset like SIGINT and SIGTERM, nil never cancels
+}
+
+// Snapshot is the ruleset loaded in the kernel, IPv6Rules and IPSets are only used by the
+// iptables backend
+type Snapshot struct {
+	Rules     []byte
+	IPv6Rules []byte
+	IPSets    string // ipset script filling the fw- sets back, empty when ipsets are not used
+}
+
+// SaveRules returns a snapshot of the ruleset currently loaded in the kernel
+func SaveRules(cfg *config.Config) (Snapshot, error) {
+	var snapshot Snapshot
+	var err error
+	switch cfg.Backend {
+	case BackendIPTables:
+		if snapshot.Rules, err = exec.Command(cfg.IptablesSaveBinary).Output(); err != nil {
+			return snapshot, err
+		}
+		if cfg.Ip6tablesRestoreBinary != "" {
+			if snapshot.IPv6Rules, err = exec.Command(cfg.Ip6tablesSaveBinary).Output(); err != nil {
+				return snapshot, err
+			}
+		}
+		snapshot.IPSets, err = SaveIPSets(cfg)
+		return snapshot, err
+	case BackendNftables:
+		snapshot.Rules, err = exec.Command(cfg.NftBinary, "list", "ruleset").Output()
+		return snapshot, err
+	}
+	return snapshot, fmt.Errorf("unknown firewall backend %q", cfg.Backend)
+}
+
+// RestoreRules loads a snapshot taken by SaveRules back into the kernel
+func RestoreRules(cfg *config.Config, snapshot Snapshot) error {
+	switch cfg.Backend {
+	case BackendIPTables:
+		// the sets are filled back first, the restored rules match them
+		if snapshot.IPSets != "" {
+			if _, err := runRestore(cfg.IpsetBinary, []byte(snapshot.IPSets), "restore"); err != nil {
+				return err
+			}
+		}
+		if _, err := runRestore(cfg.IptablesRestoreBinary, snapshot.Rules); err != nil {
+			return err
+		}
+		if snapshot.IPv6Rules != nil {
+			if _, err := runRestore(cfg.Ip6tablesRestoreBinary, snapshot.IPv6Rules); err != nil {
+				return err
+			}
+		}
+		destroyStaleIPSets(cfg, snapshot.IPSets)
+		return nil
+	case BackendNftables:
+		// nft list ruleset has no flush statement, the snapshot would be merged into the new ruleset
+		_, err := runRestore(cfg.NftBinary, append([]byte("flush ruleset\n"), snapshot.Rules...), "-f", "-")
+		return err
+	}
+	return fmt.Errorf("unknown firewall backend %q", cfg.Backend)
+}
+
+// Confirm tells a running ApplyRulesWithRollback to keep the new ruleset
+func Confirm(cfg *config.Config) error {
+	return os.WriteFile(cfg.ConfirmFile, nil, 0600)
+}
+
+// ApplyRulesWithRollback snapshots the live ruleset, applies the rules files and restores the
+// snapshot unless Confirm is called or an admin connects to the probe address before the timeout.
+// The snapshot is also restored when the process is interrupted or terminated while waiting.
+func ApplyRulesWithRollback(cfg *config.Config, opts RollbackOptions) ([]byte, error) {
+	snapshot, err := SaveRules(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("saving current ruleset: %w", err)
+	}
+	parent := opts.Context
+	if parent == nil {
+		parent = context.Background()
+	}
+	// the ssh session of the admin may drop with the new rules, its SIGHUP must not end the
+	// process before the rollback
+	signal.Ignore(syscall.SIGHUP)
+	defer signal.Reset(syscall.SIGHUP)
+	ctx, stop := signal.NotifyContext(parent, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// a confirmation left over from a previous run must not confirm this one
+	os.Remove(cfg.ConfirmFile)
+
+	confirmed := make(chan string, 1)
+	if opts.ProbeAddr != "" {
+		listener, err := net.Listen("tcp", opts.ProbeAddr)
+		if err != nil {
+			return nil, fmt.Errorf("starting connectivity probe: %w", err)
+		}
+		defer listener.Close()
+		go waitForAdminProbe(listener, opts.AdminIPs, confirmed)
+	}
+
+	output, err := ApplyRules(cfg)
+	if err != nil {
+		if restoreErr := RestoreRules(cfg, snapshot); restoreErr != nil {
+			return output, fmt.Errorf("%v (restoring previous ruleset failed: %v)", err, restoreErr)
+		}
+		return output, err
+	}
+
+	fmt.Printf("Rules applied, confirm within %s or they will be rolled back\n", opts.Timeout)
+	timeout := time.After(opts.Timeout)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case source := <-confirmed:
+			fmt.Println("Rules confirmed by connectivity probe from", source)
+			return output, nil
+		case <-ticker.C:
+			if fileExists(cfg.ConfirmFile) {
+				os.Remove(cfg.ConfirmFile)
+				fmt.Println("Rules confirmed")
+				return output, nil
+			}
+		case <-ctx.Done():
+			if err := RestoreRules(cfg, snapshot); err != nil {
+				return output, fmt.Errorf("interrupted before the rules were confirmed and restoring previous ruleset failed: %w", err)
+			}
+			return output, fmt.Errorf("interrupted before the rules were confirmed, previous ruleset restored")
+		case <-timeout:
+			if err := RestoreRules(cfg, snapshot); err != nil {
+				return output, fmt.Errorf("rules not confirmed within %s and restoring previous ruleset failed: %w", opts.Timeout, err)
+			}
+			return output, fmt.Errorf("rules not confirmed within %s, previous ruleset restored", opts.Timeout)
+		}
+	}
+}
+
+// isAdminAddress reports whether host is one of the admin ips or in one of the admin prefixes
+func isAdminAddress(adminIPs []string, host string) bool {
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, admin := range adminIPs {
+		if prefix, err := netip.ParsePrefix(admin); err == nil && prefix.Contains(addr) {
+			return true
+		}
+		if adminAddr, err := netip.ParseAddr(admin); err == nil && adminAddr == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForAdminProbe accepts probe connections until one comes from an admin ip
+func waitForAdminProbe(listener net.Listener, adminIPs []string, confirmed chan<- string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		conn.Close()
+		if isAdminAddress(adminIPs, host) {
+			confirmed <- host
+			return
+		}
+	}
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return !os.IsNotExist(err)
+}
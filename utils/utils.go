@@ -6,31 +6,27 @@ import (
 	"firewall_script_docker/structs"
 	"fmt"
 	"net"
+	"net/netip"
 	"os"
 	"os/exec"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
-	"unicode"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 )
 
-func isInt(s string) bool {
-	for _, c := range s {
-		if !unicode.IsDigit(c) {
-			return false
-		}
-	}
-	return true
-}
-
+// isIPAddress accepts an ip address or a cidr prefix, prefixes are returned with their host bits cleared
 func isIPAddress(str string) (string, bool) {
 	ip := net.ParseIP(str)
 	if ip != nil {
 		return ip.String(), true
 	}
+	if prefix, err := netip.ParsePrefix(str); err == nil {
+		return prefix.Masked().String(), true
+	}
 	return "", false
 }
 
@@ -39,85 +35,129 @@ func IsDockerInstalled() bool {
 	return err == nil
 }
 
-func IsIpsetInstalled() bool {
-	_, err := exec.LookPath("ipset")
+// IsIpsetInstalled reports whether the ipset binary, a path or a name looked up in PATH, exists
+func IsIpsetInstalled(binary string) bool {
+	_, err := exec.LookPath(binary)
 	return err == nil
 }
 
+// protocols are the transport protocols accepted after a port, 53/udp
+var protocols = []string{"tcp", "udp", "sctp"}
+
 // isValidPort checks if a port number is valid (between 1 and 65535)
-func isValidPort(port string) (int, bool) {
-	portNum, err := strconv.Atoi(port)
+func isValidPort(port string) (uint16, bool) {
+	portNum, err := strconv.ParseUint(port, 10, 16)
 	if err != nil {
 		return 0, false // Not a valid integer
 	}
-	return portNum, portNum >= 1 && portNum <= 65535
+	return uint16(portNum), portNum >= 1
+}
+
+// ParsePort parses a port or a port range with an optional protocol, 80, 53/udp or 8000-8100
+func ParsePort(port string) (structs.Port, bool) {
+	numbers, proto, found := strings.Cut(strings.TrimSpace(port), "/")
+	if !found {
+		proto = "tcp"
+	}
+	proto = strings.ToLower(proto)
+	if !slices.Contains(protocols, proto) {
+		return structs.Port{}, false
+	}
+	first, last, isRange := strings.Cut(numbers, "-")
+	number, isValid := isValidPort(first)
+	if !isValid {
+		return structs.Port{}, false
+	}
+	parsed := structs.Port{Number: number, Proto: proto}
+	if isRange {
+		end, isValid := isValidPort(last)
+		if !isValid || end < number {
+			return structs.Port{}, false
+		}
+		if end > number {
+			parsed.End = end
+		}
+	}
+	return parsed, true
 }
 
-// filterValidPorts filters out invalid port numbers from the input array
-func filterValidPorts(ports []string) []int {
-	var validPorts []int
+// filterValidPorts filters out invalid and duplicate ports from the input array
+func filterValidPorts(ports []string) []structs.Port {
+	var validPorts []structs.Port
 	for _, port := range ports {
-		if port, isValid := isValidPort(port); isValid {
+		if port, isValid := ParsePort(port); isValid && !slices.Contains(validPorts, port) {
 			validPorts = append(validPorts, port)
 		}
 	}
 	return validPorts
 }
 
-// read admin_access_domains and get hosts resolve domain to ip if it's a domain
-// and concate ips by comma and return them
-func GetAdminIPs(filePath string) string {
+// ParsePorts parses a comma separated list of ports like 80,443,53/udp,8000-8100 and drops the invalid ones
+func ParsePorts(list string) []structs.Port {
+	return filterValidPorts(strings.Split(list, ","))
+}
+
+// read admin_access_domains and get hosts resolve domain to ipv4 and ipv6 addresses if it's a domain,
+// cidr prefixes are kept as they are, a missing file has no admins
+func GetAdmins(filePath string) ([]structs.Admin, error) {
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		return ""
+		return nil, err
 	}
 	defer file.Close()
 
-	var ipCentral strings.Builder
+	var admins []structs.Admin
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if ip, isIP := isIPAddress(line); isIP {
-			if ipCentral.Len() > 0 {
-				ipCentral.WriteString(",")
-			}
-			ipCentral.WriteString(ip)
-		} else {
-			ips, err := net.LookupIP(line)
-			if err == nil && len(ips) > 0 {
-				for _, ip := range ips {
-					if ip.To4() != nil {
-						if !strings.Contains(ipCentral.String(), ip.String()) && ipCentral.Len() > 0 {
-							ipCentral.WriteString(",")
-						}
-						if !strings.Contains(ipCentral.String(), ip.String()) {
-							ipCentral.WriteString(ip.String())
-						}
-					}
-				}
-			}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
+		admins = AppendAdmins(admins, line)
 	}
-	return ipCentral.String()
+	return admins, scanner.Err()
 }
 
-// read file path and get public ports returns format 80,443
-func GetPublicPorts(filePath string) (string, bool) {
+// AppendAdmins resolves host and appends its addresses not already in admins, naming host as their
+// origin when it is a hostname
+func AppendAdmins(admins []structs.Admin, host string) []structs.Admin {
+	ips, err := LookupHost(host)
+	if err != nil {
+		return admins
+	}
+	for _, ip := range ips {
+		if slices.ContainsFunc(admins, func(admin structs.Admin) bool { return admin.Source == ip }) {
+			continue
+		}
+		admin := structs.Admin{Source: ip}
+		if isHostname(host) {
+			admin.Host = host
+		}
+		admins = append(admins, admin)
+	}
+	return admins
+}
+
+// read file path and get public ports returns format 80,443,53/udp,8000-8100, a missing file has none
+func GetPublicPorts(filePath string) (string, bool, error) {
 	portTxt, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
 	if err != nil {
-		return "", false
+		return "", false, err
 	}
 	var validPorts []string
-	portsArray := strings.Split(string(portTxt), ",")
-	for _, port := range portsArray {
-		if isInt(port) && len(port) != 0 {
-			validPorts = append(validPorts, port)
-		}
+	for _, port := range ParsePorts(string(portTxt)) {
+		validPorts = append(validPorts, port.String())
 	}
 	if len(validPorts) == 0 {
-		return "", false
+		return "", false, nil
 	}
-	return strings.Join(validPorts, ","), true
+	return strings.Join(validPorts, ","), true, nil
 }
 
 // filters docker ports array only that are public which has ip 0.0.0.0
@@ -131,102 +171,163 @@ func filterPortsByIP(ports []types.Port) []types.Port {
 	return filteredPorts
 }
 
-// returns an array of unique network ids with it's subnet
+// returns an array of the unique custom networks with their bridge and subnet,
+// the default docker0 bridge is left out as the templates handle it on their own
 func GetUniqueNetworkIDs(containers []structs.ContainerInfo) []structs.NetworkID {
 	networkIDMap := make(map[string]structs.NetworkID)
 	var uniqueNetworkIDs []structs.NetworkID
 
 	for _, container := range containers {
-		networkID := structs.NetworkID{
-			ID:     container.NetworkData.NetworkID,
-			Subnet: container.NetworkSubnet,
-		}
+		for _, endpoint := range container.Endpoints {
+			if endpoint.Bridge == "docker0" {
+				continue
+			}
+			networkID := structs.NetworkID{
+				ID:     endpoint.NetworkID,
+				Bridge: endpoint.Bridge,
+				Subnet: endpoint.Subnet,
+			}
 
-		key := fmt.Sprintf("%s-%s", networkID.ID, networkID.Subnet)
-		if _, exists := networkIDMap[key]; !exists {
-			networkIDMap[key] = networkID
-			uniqueNetworkIDs = append(uniqueNetworkIDs, networkID)
+			key := fmt.Sprintf("%s-%s", networkID.ID, networkID.Subnet)
+			if _, exists := networkIDMap[key]; !exists {
+				networkIDMap[key] = networkID
+				uniqueNetworkIDs = append(uniqueNetworkIDs, networkID)
+			}
 		}
 	}
 
 	return uniqueNetworkIDs
 }
 
-func GetContainerInfos(cli *client.Client) []structs.ContainerInfo {
+// bridgeNameOption is the network option holding a custom name for the bridge interface
+const bridgeNameOption = "com.docker.network.bridge.name"
+
+// returns the first ipv4 or ipv6 subnet of the network ipam config
+func networkSubnet(network types.NetworkResource, ipv6 bool) string {
+	for _, config := range network.IPAM.Config {
+		if prefix, err := netip.ParsePrefix(config.Subnet); err == nil && prefix.Addr().Is6() == ipv6 {
+			return config.Subnet
+		}
+	}
+	return ""
+}
+
+// returns one endpoint per network the container is attached to, sorted by network name
+// networks are cached by id as most containers share the same few networks
+func getContainerEndpoints(ctx context.Context, source ContainerSource, networks map[string]types.NetworkResource, settings *types.SummaryNetworkSettings) ([]structs.Endpoint, error) {
+	var endpoints []structs.Endpoint
+	if settings == nil {
+		return nil, nil
+	}
+	for name, value := range settings.Networks {
+		// host and none networks have no address of their own
+		if value.IPAddress == "" && value.GlobalIPv6Address == "" {
+			continue
+		}
+		network, cached := networks[value.NetworkID]
+		if !cached {
+			var err error
+			network, err = source.NetworkInspect(ctx, value.NetworkID, types.NetworkInspectOptions{})
+			if err != nil {
+				return nil, &DockerError{Op: "inspecting network " + shortID(value.NetworkID), Err: err}
+			}
+			networks[value.NetworkID] = network
+		}
+		networkID := shortID(value.NetworkID)
+		var bridge string
+		if name == "bridge" {
+			bridge = "docker0"
+		} else if network.Options[bridgeNameOption] != "" {
+			bridge = network.Options[bridgeNameOption]
+		} else {
+			bridge = "br-" + networkID
+		}
+		endpoints = append(endpoints, structs.Endpoint{
+			NetworkID:   networkID,
+			NetworkName: name,
+			Bridge:      bridge,
+			IPAddress:   value.IPAddress,
+			Subnet:      networkSubnet(network, false),
+			IPv6Address: value.GlobalIPv6Address,
+			IPv6Subnet:  networkSubnet(network, true),
+		})
+	}
+	// map iteration order is random, keep the rendered ruleset stable
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].NetworkName < endpoints[j].NetworkName
+	})
+	return endpoints, nil
+}
+
+// GetContainerInfos returns the containers of source with their published ports and the
+// endpoints of the networks they are attached to
+func GetContainerInfos(source ContainerSource) ([]structs.ContainerInfo, error) {
 	ctx := context.Background()
-	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	containers, err := source.ContainerList(ctx, container.ListOptions{All: true})
 	if err != nil {
-		panic(err)
+		return nil, &DockerError{Op: "listing containers", Err: err}
 	}
+	networks := make(map[string]types.NetworkResource)
 	var containerInfos []structs.ContainerInfo
 	for _, container := range containers {
-		var iPAddress string
-		var networkData structs.NetworkMetaData
-		for key, value := range container.NetworkSettings.Networks {
-			iPAddress = value.IPAddress
-			var Name string
-			if key == "bridge" {
-				Name = "docker0"
-			} else {
-				Name = key
-			}
-			networkData = structs.NetworkMetaData{
-				Name:      Name,
-				NetworkID: value.NetworkID[:12],
-			}
-		}
-		network, err := cli.NetworkInspect(ctx, networkData.NetworkID, types.NetworkInspectOptions{})
+		endpoints, err := getContainerEndpoints(ctx, source, networks, container.NetworkSettings)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
 		containerInfos = append(containerInfos, structs.ContainerInfo{
-			ContainerID:   container.ID[:12],
-			Ports:         filterPortsByIP(container.Ports),
-			NetworkData:   networkData,
-			NetworkSubnet: network.IPAM.Config[0].Subnet,
-			IPAddress:     iPAddress,
+			ContainerID: shortID(container.ID),
+			Name:        containerName(container.Names),
+			Labels:      container.Labels,
+			Ports:       filterPortsByIP(container.Ports),
+			Endpoints:   endpoints,
 		})
 	}
 
-	return containerInfos
+	return containerInfos, nil
 }
 
-func UniquePublicPorts(containers []structs.ContainerInfo) []uint16 {
-	uniquePorts := make(map[uint16]int)
+// containerName returns the name docker shows for a container, without the leading slash
+func containerName(names []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimPrefix(names[0], "/")
+}
+
+// shortID returns the 12 characters docker shows of a container or network id
+func shortID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
 
+// returns the unique ports published by the containers with their protocol
+func UniquePublicPorts(containers []structs.ContainerInfo) []structs.Port {
+	var result []structs.Port
 	for _, container := range containers {
 		for _, port := range container.Ports {
-			if port.PublicPort != 0 {
-				uniquePorts[port.PublicPort] = 1
+			publicPort := structs.Port{Number: port.PublicPort, Proto: port.Type}
+			if port.PublicPort != 0 && IsPortNotInArray(result, publicPort) {
+				result = append(result, publicPort)
 			}
 		}
 	}
-
-	result := make([]uint16, 0, len(uniquePorts))
-	for port := range uniquePorts {
-		result = append(result, port)
-	}
-
 	return result
 }
 
-func IsPortNotInArray(ports []uint16, port uint16) bool {
-	for _, p := range ports {
-		if p == port {
-			return false
-		}
-	}
-	return true
+func IsPortNotInArray(ports []structs.Port, port structs.Port) bool {
+	return !slices.Contains(ports, port)
 }
 
-func FilterPortsArray(mappedPortsData map[string][]uint16, filter []uint16) map[string][]uint16 {
-	result := make(map[string][]uint16)
+func FilterPortsArray(mappedPortsData map[string][]structs.Port, filter []structs.Port) map[string][]structs.Port {
+	result := make(map[string][]structs.Port)
 
 	for key, arr := range mappedPortsData {
-		var filteredArr []uint16
-		for _, num := range arr {
-			if IsPortNotInArray(filter, num) {
-				filteredArr = append(filteredArr, num)
+		var filteredArr []structs.Port
+		for _, port := range arr {
+			if IsPortNotInArray(filter, port) {
+				filteredArr = append(filteredArr, port)
 			}
 		}
 		result[key] = filteredArr
@@ -235,19 +336,38 @@ func FilterPortsArray(mappedPortsData map[string][]uint16, filter []uint16) map[
 	return result
 }
 
-// checkIfIPExists checks if an IP address exists in the array of AccessDomain structs
-func checkIfIPExists(domains []structs.AccessDomain, ip string) bool {
-	for _, domain := range domains {
-		if domain.IP == ip {
-			return true
-		}
+// domainWithIP returns the index of the AccessDomain listing an IP address, -1 when none does
+func domainWithIP(domains []structs.AccessDomain, ip string) int {
+	return slices.IndexFunc(domains, func(domain structs.AccessDomain) bool { return slices.Contains(domain.IPs, ip) })
+}
+
+// isHostname reports whether host of an access file is a name to resolve rather than an ip or a prefix
+func isHostname(host string) bool {
+	_, isIP := isIPAddress(host)
+	return !isIP
+}
+
+// SplitAccessLine splits a host:80,443 line of the access files, ipv6 literals are written in brackets [2001:db8::1]:80,443
+func SplitAccessLine(line string) (string, string, bool) {
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "[") {
+		host, ports, found := strings.Cut(line[1:], "]:")
+		return host, ports, found
+	}
+	host, ports, found := strings.Cut(line, ":")
+	if strings.Contains(ports, ":") {
+		// an ipv6 literal without brackets, the ports can't be told apart from the address
+		return "", "", false
 	}
-	return false
+	return host, ports, found
 }
 
-// read the file gets the host and return the host with it's access port list
+// read the file gets the host and return the host with it's access port list, a missing file has none
 func ProcessDomainFile(filePath string) ([]structs.AccessDomain, error) {
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -256,50 +376,71 @@ func ProcessDomainFile(filePath string) ([]structs.AccessDomain, error) {
 	var domains []structs.AccessDomain
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) < 2 {
+		host, ports, found := SplitAccessLine(scanner.Text())
+		if !found {
 			continue
 		}
-		portsArr := filterValidPorts(strings.Split(parts[1], ","))
-		ip, err := resolveIPAddress(parts[0])
-		if err != nil || len(ip) == 0 {
+		portsArr := ParsePorts(ports)
+		addresses, err := LookupHost(host)
+		if err != nil {
 			continue
 		}
-		domain := structs.AccessDomain{
-			Name:     parts[0],
-			IP:       ip,
-			Ports:    parts[1],
-			PortsArr: portsArr,
+		// an address already listed by a previous line gets the ports of this line added to that line
+		var ips []string
+		for _, ip := range addresses {
+			if i := domainWithIP(domains, ip); i >= 0 {
+				addPorts(&domains[i], portsArr)
+			} else if !slices.Contains(ips, ip) {
+				ips = append(ips, ip)
+			}
 		}
-		if !checkIfIPExists(domains, ip) {
-			domains = append(domains, domain)
+		if len(ips) == 0 {
+			continue
 		}
+		domains = append(domains, structs.AccessDomain{
+			Name:     host,
+			IPs:      ips,
+			Ports:    ports,
+			PortsArr: portsArr,
+		})
 	}
-	return domains, nil
+	return domains, scanner.Err()
 }
 
-func resolveIPAddress(host string) (string, error) {
-	var iPAddress string
-	if ip, isIP := isIPAddress(host); isIP {
-		iPAddress = ip
-	} else {
-		ips, err := net.LookupIP(host)
-		if err != nil {
-			return "", err
+// addPorts adds the ports a domain doesn't have yet to its ports
+func addPorts(domain *structs.AccessDomain, ports []structs.Port) {
+	for _, port := range ports {
+		if !slices.Contains(domain.PortsArr, port) {
+			domain.PortsArr = append(domain.PortsArr, port)
+			if domain.Ports != "" {
+				domain.Ports += ","
+			}
+			domain.Ports += port.String()
 		}
-		iPAddress = ips[0].String()
 	}
-	return iPAddress, nil
+}
+
+// LookupHost returns every ipv4 and ipv6 address of a host, ips and cidr prefixes are returned as they are.
+// Hostnames are cached until their dns ttl expires.
+func LookupHost(host string) ([]string, error) {
+	if ip, isIP := isIPAddress(host); isIP {
+		return []string{ip}, nil
+	}
+	return hostResolver.Lookup(host)
 }
 
 // read the authorized_access_ips file and parse it return each ip and it's access port
-// ips that will have access to certain docker ports
-func ProcessAuthorizedAccessFile(filePath string) map[string][]uint16 {
-	ipsByPort := make(map[string][]uint16)
+// ips that will have access to certain docker ports, every address of a hostname is returned
+// with the hostname it was resolved from, a missing file has none
+func ProcessAuthorizedAccessFile(filePath string) (map[string][]structs.Port, map[string]string, error) {
+	ipsByPort := make(map[string][]structs.Port)
+	hostNames := make(map[string]string)
 	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
 	if err != nil {
-		return nil
+		return nil, nil, err
 	}
 	defer file.Close()
 
@@ -307,29 +448,39 @@ func ProcessAuthorizedAccessFile(filePath string) map[string][]uint16 {
 	// Read the file line by line
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Split(line, ":")
-		if len(parts) != 2 {
+		host, hostPorts, found := SplitAccessLine(scanner.Text())
+		if !found {
 			continue
 		}
-		ip, err := resolveIPAddress(parts[0])
-		if err != nil || len(ip) == 0 {
+		ips, err := LookupHost(host)
+		if err != nil {
 			continue
 		}
-		ports := strings.Split(parts[1], ",")
-		for _, port := range ports {
-			ipPort := strings.TrimSpace(port)
-			if ipPort != "" && isInt(port) {
-				portNumber, err := strconv.ParseUint(port, 10, 16)
-				if err != nil {
-					panic(err)
-				}
-				if IsPortNotInArray(ipsByPort[ip], uint16(portNumber)) {
-					ipsByPort[ip] = append(ipsByPort[ip], uint16(portNumber))
+		for _, ip := range ips {
+			if _, found := hostNames[ip]; !found && isHostname(host) {
+				hostNames[ip] = host
+			}
+			for _, port := range ParsePorts(hostPorts) {
+				if IsPortNotInArray(ipsByPort[ip], port) {
+					ipsByPort[ip] = append(ipsByPort[ip], port)
 				}
 			}
 		}
 	}
 
-	return ipsByPort
+	return ipsByPort, hostNames, scanner.Err()
+}
+
+// EntityHostNames returns the hostname each address of the entity domains was resolved from
+func EntityHostNames(domains []structs.AccessDomain) map[string]string {
+	hostNames := make(map[string]string)
+	for _, domain := range domains {
+		if !isHostname(domain.Name) {
+			continue
+		}
+		for _, ip := range domain.IPs {
+			hostNames[ip] = domain.Name
+		}
+	}
+	return hostNames
 }
@@ -0,0 +1,200 @@
+package utils
+
+import (
+	"firewall_script_docker/structs"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Diagnostic is a problem found at a line and column of an access or policy file, both start at 1,
+// a Line of 0 is a problem with the whole file
+type Diagnostic struct {
+	File   string
+	Line   int
+	Column int
+	Reason string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return fmt.Sprintf("%s: %s", d.File, d.Reason)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Reason)
+}
+
+// badPortReason is reported for every port that ParsePort rejects
+const badPortReason = "bad port %q, expected a port or a range between 1 and 65535 with an optional /tcp, /udp or /sctp"
+
+// readFileLines returns the lines of a file, a file that can't be read is reported as a diagnostic.
+// A missing file has no lines like in apply, unless it is required.
+func readFileLines(filePath string, required bool) ([]string, []Diagnostic) {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) && !required {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, []Diagnostic{{File: filePath, Reason: err.Error()}}
+	}
+	return strings.Split(string(content), "\n"), nil
+}
+
+// indent returns the number of bytes of leading white space of a line
+func indent(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " \t"))
+}
+
+// isPublished reports whether a container publishes a port of the range
+func isPublished(port structs.Port, published []structs.Port) bool {
+	for _, publishedPort := range published {
+		last := port.Number
+		if port.End != 0 {
+			last = port.End
+		}
+		if publishedPort.Proto == port.Proto && port.Number <= publishedPort.Number && publishedPort.Number <= last {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateAdminFile reports the hosts of the admins file that can't be resolved or are listed twice
+func ValidateAdminFile(filePath string) []Diagnostic {
+	lines, diagnostics := readFileLines(filePath, true)
+	seen := make(map[string]int)
+	for i, line := range lines {
+		host := strings.TrimSpace(line)
+		if host == "" {
+			continue
+		}
+		at := Diagnostic{File: filePath, Line: i + 1, Column: indent(line) + 1}
+		ips, err := LookupHost(host)
+		if err != nil {
+			at.Reason = fmt.Sprintf("host %q could not be resolved", host)
+			diagnostics = append(diagnostics, at)
+			continue
+		}
+		for _, ip := range ips {
+			if previous, found := seen[ip]; found {
+				at.Reason = fmt.Sprintf("duplicate entry, %s is already an admin on line %d", ip, previous)
+				diagnostics = append(diagnostics, at)
+				break
+			}
+			seen[ip] = i + 1
+		}
+	}
+	if lines != nil && len(seen) == 0 {
+		diagnostics = append(diagnostics, Diagnostic{File: filePath, Reason: "no admin ip could be resolved, apply refuses to run without admins"})
+	}
+	return diagnostics
+}
+
+// ValidateAccessFile reports the host:80,443 lines of an access file with a bad format, an unresolvable
+// host, a bad or duplicate port or a host listed twice. With checkPublished the ports must also be
+// published by one of the containers.
+func ValidateAccessFile(filePath string, published []structs.Port, checkPublished bool) []Diagnostic {
+	lines, diagnostics := readFileLines(filePath, false)
+	seen := make(map[string]int)
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		report := func(column int, format string, a ...any) {
+			diagnostics = append(diagnostics, Diagnostic{File: filePath, Line: i + 1, Column: column, Reason: fmt.Sprintf(format, a...)})
+		}
+		hostColumn := indent(line) + 1
+		host, ports, found := SplitAccessLine(line)
+		if !found {
+			if strings.Count(line, ":") > 1 && !strings.HasPrefix(strings.TrimSpace(line), "[") {
+				report(hostColumn, "ipv6 addresses must be written in brackets, [2001:db8::1]:80,443")
+			} else {
+				report(hostColumn, "expected host:port1,port2")
+			}
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			hostColumn++
+		}
+
+		ips, err := LookupHost(host)
+		if err != nil {
+			report(hostColumn, "host %q could not be resolved", host)
+		}
+		for _, ip := range ips {
+			if previous, found := seen[ip]; found {
+				report(hostColumn, "duplicate entry, %s is already listed on line %d", ip, previous)
+				break
+			}
+		}
+		for _, ip := range ips {
+			if _, found := seen[ip]; !found {
+				seen[ip] = i + 1
+			}
+		}
+
+		// the ports follow the last colon, after the brackets of an ipv6 address
+		offset := strings.LastIndex(line, ":") + 1
+		var linePorts []structs.Port
+		for _, token := range strings.Split(ports, ",") {
+			column := offset + indent(token) + 1
+			offset += len(token) + 1
+			port, isValid := ParsePort(token)
+			switch {
+			case !isValid:
+				report(column, badPortReason, strings.TrimSpace(token))
+			case slices.Contains(linePorts, port):
+				report(column, "duplicate port %s", port)
+			case checkPublished && !isPublished(port, published):
+				report(column, "port %s is not published by any container", port)
+			}
+			linePorts = append(linePorts, port)
+		}
+	}
+	return diagnostics
+}
+
+// ValidatePublicPortsFile reports the bad and duplicate ports of the public ports file, read
+// like GetPublicPorts as a single comma separated list
+func ValidatePublicPortsFile(filePath string) []Diagnostic {
+	content, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil // like a missing file in apply, no port is opened
+	}
+	if err != nil {
+		return []Diagnostic{{File: filePath, Reason: err.Error()}}
+	}
+	if strings.TrimSpace(string(content)) == "" {
+		return nil // an empty file opens no port
+	}
+	var diagnostics []Diagnostic
+	var ports []structs.Port
+	line, column := 1, 1
+	for _, token := range strings.Split(string(content), ",") {
+		// position of the first character of the port in the token
+		at := Diagnostic{File: filePath, Line: line, Column: column}
+		for _, c := range token[:len(token)-len(strings.TrimLeft(token, " \t\r\n"))] {
+			at.Column++
+			if c == '\n' {
+				at.Line, at.Column = at.Line+1, 1
+			}
+		}
+		if newlines := strings.Count(token, "\n"); newlines > 0 {
+			line, column = line+newlines, len(token)-strings.LastIndex(token, "\n")+1
+		} else {
+			column += len(token) + 1
+		}
+
+		port, isValid := ParsePort(token)
+		switch {
+		case !isValid:
+			at.Reason = fmt.Sprintf(badPortReason, strings.TrimSpace(token))
+			diagnostics = append(diagnostics, at)
+		case slices.Contains(ports, port):
+			at.Reason = fmt.Sprintf("duplicate port %s", port)
+			diagnostics = append(diagnostics, at)
+		}
+		ports = append(ports, port)
+	}
+	return diagnostics
+}